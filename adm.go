@@ -5,8 +5,6 @@ import (
     "log"
     "runtime"
     "os"
-    "strconv"
-    "strings"
     "sync"
     "time"
 )
@@ -37,17 +35,23 @@ type ADMManager struct {
     writeMode WriteMode
     reader Reader
     writer Writer
+    chunks *ChunkFiles
+    pipeline *Pipeline
+    client *QueryClient
     workers *Sema
     openIO *Sema
+    timeseriesReads *AdaptiveSema
+    budget *MemoryBudget
     config *AdmConfig
     chunkSize int64
     log             *Logger
     errorChan chan *ErrorLog
 }
 
-func newADMManager(config *AdmConfig) *ADMManager {
-    logger := newLogger()
-
+/* Sets up the reader, writer and pipeline of config. Fails on settings that can
+ * only be checked by using them, e.g. an unreadable ca_file or a corrupt manifest.
+ */
+func newADMManager(config *AdmConfig) (*ADMManager, error) {
     mdata_dest :=getDirPath(config.MetadataDest)
     os.MkdirAll(mdata_dest, os.ModePerm)
 
@@ -55,39 +59,90 @@ func newADMManager(config *AdmConfig) *ADMManager {
     fmt.Println("TSR DEST:", tsr_dest, mdata_dest)
     os.MkdirAll(tsr_dest, os.ModePerm)
 
-    reader := configureReader(config.ReadMode)
+    timeseriesReads := newAdaptiveSema(config.Concurrency.withDefaults(config.WorkerSize, config.OpenIO))
+    client, err := newQueryClient(config.Retry, config.Source, newCircuitBreaker(config.Breaker), newRateLimiter(config.RateLimit), timeseriesReads)
+    if err != nil {
+        return nil, fmt.Errorf("newADMManager: could not configure source endpoint err: %v", err)
+    }
+    budget := newMemoryBudget(config.MemoryLimit)
+    reader := configureReader(config, client, budget)
 
     if reader == nil {
-        log.Println("fatal: read mode unknown")
-        return nil
+        return nil, fmt.Errorf("newADMManager: read mode unknown")
+    }
+
+    pipeline, err := newPipeline(config.Transforms)
+    if err != nil {
+        return nil, fmt.Errorf("newADMManager: could not configure transforms err: %v", err)
+    }
+    if config.Quality.Enabled {
+        err = pipeline.analyze(config.Quality)
+        if err != nil {
+            return nil, fmt.Errorf("newADMManager: could not configure the data quality analysis err: %v", err)
+        }
+    }
+    if config.Dedup.Enabled {
+        pipeline.deduplicate()
+    }
+    if config.Remap.enabled() {
+        err = pipeline.remap(config.Remap)
+        if err != nil {
+            return nil, fmt.Errorf("newADMManager: could not configure remap rules err: %v", err)
+        }
+    }
+    if config.Downsample.enabled() {
+        err = pipeline.downsample(config.Downsample)
+        if err != nil {
+            return nil, fmt.Errorf("newADMManager: could not configure downsampling err: %v", err)
+        }
+    }
+    err = pipeline.formatTimes(config.Output)
+    if err != nil {
+        return nil, fmt.Errorf("newADMManager: could not configure the output time format err: %v", err)
     }
 
-    writer := configureWriter(config.WriteMode)
+    var chunks *ChunkFiles
+    if config.WriteMode == WM_FILE {
+        chunks, err = newChunkFiles(config.Output, config.TimeseriesDest, config.Compression)
+        if err != nil {
+            return nil, fmt.Errorf("newADMManager: could not set up output files err: %v", err)
+        }
+    }
 
-    if writer == nil {
-        log.Println("fatal: write mode unknown")
-        return nil
+    writer, err := configureWriter(config, chunks)
+    if err != nil {
+        return nil, err
     }
 
+    logger := newLogger()
     return &ADMManager{
         url:      config.SourceUrl,
         readMode: config.ReadMode,
         writeMode: config.WriteMode,
         reader: reader,
         writer: writer,
+        chunks: chunks,
+        pipeline: pipeline,
+        client: client,
         workers: newSema(config.WorkerSize),
         openIO: newSema(config.OpenIO),
+        timeseriesReads: timeseriesReads,
+        budget: budget,
         config: config,
         chunkSize: config.ChunkSize,
         log:      logger,
         errorChan: make(chan *ErrorLog, 100),
-    }
+    }, nil
 }
 
-func configureReader(mode ReadMode) Reader {
-    switch mode {
+func configureReader(config *AdmConfig, client *QueryClient, budget *MemoryBudget) Reader {
+    switch config.ReadMode {
         case RM_GILES:
-            return newGilesReader()
+            reader := newGilesReader(client, config.Giles, budget)
+            if config.Downsample.enabled() && config.Downsample.Pushdown {
+                reader.pushdown(config.Downsample)
+            }
+            return reader
         case RM_FILE:
             fmt.Println("file reader not yet developed")
             return nil
@@ -97,18 +152,20 @@ func configureReader(mode ReadMode) Reader {
     return nil
 }
 
-func configureWriter(mode WriteMode) Writer {
-    switch mode {
+func configureWriter(config *AdmConfig, chunks *ChunkFiles) (Writer, error) {
+    switch config.WriteMode {
         case WM_GILES:
-            fmt.Println("network writer not yet developed")
-            break
+            //the destination's auth and TLS settings are checked even before the writer exists
+            _, err := newNetworkWriter(config.Destination, config.Retry.RequestTimeout)
+            if err != nil {
+                return nil, fmt.Errorf("configureWriter: could not configure destination endpoint err: %v", err)
+            }
+            return nil, fmt.Errorf("configureWriter: network writer not yet developed")
         case WM_FILE:
-            return newFileWriter()
+            return newFileWriter(config.Compression, chunks), nil
         default:
-            log.Println("write mode unknown")
-            return nil
+            return nil, fmt.Errorf("configureWriter: write mode unknown")
     }
-    return nil
 }
 
 func (adm *ADMManager) processUuids() {
@@ -133,6 +190,7 @@ func (adm *ADMManager) processUuids() {
 func (adm *ADMManager) processMetadata() {
     if adm.log.getLogMetadata(METADATA_WRITTEN) == WRITE_COMPLETE {
         fmt.Println("processMetadata: Writing metadata complete")
+        adm.loadMetadataIndex()
         return
     }
 
@@ -140,6 +198,7 @@ func (adm *ADMManager) processMetadata() {
     wg.Add(2)
 
     dataChan := make(chan *MetadataTuple, CHANNEL_BUFFER_SIZE)
+    writeChan, transformed := adm.transformMetadata(dataChan)
     errored := false
     dest := adm.getMetadataDest()
 
@@ -156,8 +215,10 @@ func (adm *ADMManager) processMetadata() {
             log.Println(err)
             if !err.Fatal() {
                 //write the bad uuids to text
-                for _, uuid := range err.Failed() {
+                for _, failed := range err.Failed() {
+                    uuid, cause := unwrapFailed(failed)
                     badUuid := uuid.(string)
+                    log.Println("processMetadata:", queryErrorKind(cause), "failure for uuid:", badUuid)
                     errLog := newErrorLog(badUuid, METADATA_ERROR, 0, 0)
                     adm.errorChan <- errLog
                 }
@@ -173,13 +234,15 @@ func (adm *ADMManager) processMetadata() {
         defer adm.workers.release()
         defer adm.openIO.release()
         fmt.Println("processMetadata: Starting to write metadata")
-        err := adm.writer.writeMetadata(dest, dataChan)
-
         badUuids := make(map[string]bool)
-        if err != nil {
+        for _, err := range []*ProcessError{adm.writer.writeMetadata(dest, writeChan), <-transformed} {
+            if err == nil {
+                continue
+            }
             log.Println(err)
             if !err.Fatal() {
-                for _, uuid := range err.Failed() {
+                for _, failed := range err.Failed() {
+                    uuid, _ := unwrapFailed(failed)
                     badUuid := uuid.(string)
 
                     badUuids[badUuid] = true
@@ -209,15 +272,41 @@ func (adm *ADMManager) processMetadata() {
     log.Println("processMetadata: completed")
 }
 
+/* Fills the pipeline's metadata index from the metadata written by a previous run. */
+func (adm *ADMManager) loadMetadataIndex() {
+    if !adm.pipeline.needsMetadata() {
+        return
+    }
+    if adm.writeMode != WM_FILE {
+        log.Println("loadMetadataIndex: metadata written by a previous run can only be loaded in file write mode")
+        return
+    }
+    dest := adm.getMetadataDest()()
+    err := adm.pipeline.index.load(dest)
+    if err != nil {
+        log.Println("loadMetadataIndex: could not load metadata from", dest, "err:", err)
+        return
+    }
+    if remapper := adm.pipeline.uuidRemapper(); remapper != nil {
+        //the written metadata carries destination uuids. transforms look up source uuids.
+        for _, uuid := range adm.uuids {
+            if record, ok := adm.pipeline.index.lookup(remapper.uuid(uuid)); ok {
+                adm.pipeline.index.put(uuid, record)
+            }
+        }
+    }
+    fmt.Println("loadMetadataIndex: loaded metadata of", adm.pipeline.index.size(), "uuids")
+}
+
 func (adm *ADMManager) getMetadataDest() func() string {
     return func() string {
         switch adm.readMode {
             case RM_FILE:
-                return adm.config.MetadataDest //placeholder
+                return adm.config.MetadataDest + adm.config.Compression.extension() //placeholder
             case RM_GILES:
-                return adm.config.MetadataDest
+                return adm.config.MetadataDest + adm.config.Compression.extension()
             default:
-                return adm.config.MetadataDest //placeholder
+                return adm.config.MetadataDest + adm.config.Compression.extension() //placeholder
         }
     }
 }
@@ -286,23 +375,45 @@ func (adm *ADMManager) processTimeseriesData() {
             //dummy slot will always trigger final FileSize check
             if (currentSize >= adm.chunkSize) && len(slotsToWrite) > 0 { 
 
+                //hold back new reads while the source is down
+                err := adm.client.breaker.waitUntilHealthy()
+                if err != nil {
+                    log.Println("processTimeseriesData:", err)
+                }
+
                 dataChan := make(chan *TimeseriesTuple, CHANNEL_BUFFER_SIZE)
+                writeChan, transformed := adm.transformTimeseries(dataChan)
                 wg.Add(2)
 
-                adm.workers.acquire()
-                adm.openIO.acquire()
+                //slots that failed to read, true if transiently or fatally. those are left incomplete so the next run retries them
+                readFailedChan := make(chan map[*TimeSlot]bool, 1)
+
+                adm.timeseriesReads.acquire()
                 log.Println("timeseries read resources acquired")
                 go func(slotsToWrite []*TimeSlot, dataChan chan *TimeseriesTuple, wg *sync.WaitGroup) {
                     defer wg.Done()
-                    defer adm.workers.release()
-                    defer adm.openIO.release()
+                    defer adm.timeseriesReads.release()
+                    readFailed := make(map[*TimeSlot]bool)
+                    defer func() { readFailedChan <- readFailed }()
                     log.Println("timeseries read starting. # slots:", len(slotsToWrite))
                     err := adm.reader.readTimeseriesData(adm.url, slotsToWrite, dataChan)
                     if err != nil {
                         log.Println(err)
-                        if !err.Fatal() {
-                            for _, slot := range err.Failed() {
+                        if err.Fatal() {
+                            //e.g. the source is unreachable. nothing read can be trusted to be complete
+                            log.Println("processTimeseriesData: fatal read failure, all", len(slotsToWrite), "slots will retry on next run")
+                            for _, slot := range slotsToWrite {
+                                readFailed[slot] = true
+                            }
+                        } else {
+                            for _, failed := range err.Failed() {
+                                slot, cause := unwrapFailed(failed)
                                 badSlot := slot.(*TimeSlot)
+                                readFailed[badSlot] = isTransient(cause)
+                                if isTransient(cause) {
+                                    log.Println("processTimeseriesData: transient failure for uuid:", badSlot.Uuid, "will retry on next run")
+                                    continue
+                                }
                                 errLog := newErrorLog(badSlot.Uuid, TIMESERIES_ERROR, badSlot.StartTime, badSlot.EndTime)
                                 adm.errorChan <- errLog
                             }
@@ -315,18 +426,22 @@ func (adm *ADMManager) processTimeseriesData() {
                 adm.workers.acquire()
                 adm.openIO.acquire()
                 log.Println("timeseries write resources acquired")
-                go func(dest string, slotsToWrite []*TimeSlot, dataChan chan *TimeseriesTuple, wg *sync.WaitGroup) {
+                go func(dest string, slotsToWrite []*TimeSlot, writeChan chan *TimeseriesTuple, transformed chan *ProcessError, wg *sync.WaitGroup) {
                     defer wg.Done()
                     defer adm.workers.release()
                     defer adm.openIO.release()
                     log.Println("timeseries write starting", dest)
-                    err := adm.writer.writeTimeseriesData(dest, dataChan)
-
                     badSlots := make(map[*TimeSlot]bool)
-                    if err != nil {
+                    writeFatal := false
+                    for _, err := range []*ProcessError{adm.writer.writeTimeseriesData(dest, writeChan), <-transformed} {
+                        if err == nil {
+                            continue
+                        }
                         log.Println(err)
+                        writeFatal = writeFatal || err.Fatal()
                         if !err.Fatal() {
-                            for _, slot := range err.Failed() {
+                            for _, failed := range err.Failed() {
+                                slot, _ := unwrapFailed(failed)
                                 badSlot := slot.(*TimeSlot)
 
                                 badSlots[badSlot] = true
@@ -338,14 +453,23 @@ func (adm *ADMManager) processTimeseriesData() {
                         errored = true
                     }
 
+                    readFailed := <-readFailedChan
+                    complete := make([]*TimeSlot, 0)
                     for _, slot := range slotsToWrite {
-                        if _, ok := badSlots[slot]; !ok {
+                        if _, ok := badSlots[slot]; !ok && !writeFatal && !readFailed[slot] {
                             adm.log.updateUuidTimeseriesStatus(slot, WRITE_COMPLETE)
                         }
+                        if _, failed := readFailed[slot]; !writeFatal && !badSlots[slot] && !failed {
+                            complete = append(complete, slot) //only copies of these replace earlier ones
+                        }
+                    }
+                    err := adm.chunks.markComplete(complete)
+                    if err != nil {
+                        log.Println("processTimeseriesData: could not record complete slots in the manifest err:", err)
                     }
 
                     log.Println("timeseries written, resources released")
-                }(dest(), slotsToWrite, dataChan, &wg)
+                }(dest(slotsToWrite), slotsToWrite, writeChan, transformed, &wg)
 
                 if !empty {
                     currentSize = timeSlot.Count
@@ -356,11 +480,34 @@ func (adm *ADMManager) processTimeseriesData() {
     }
 
     wg.Wait()
+    adm.finishDedup()
     if !errored {
         adm.log.updateLogMetadata(TIMESERIES_WRITTEN, WRITE_COMPLETE)
     }
 }
 
+/* Removes slots written again by this run from earlier output and writes the dedup report. */
+func (adm *ADMManager) finishDedup() {
+    if !adm.pipeline.deduplicates() {
+        return
+    }
+    report := adm.pipeline.deduplicator.report
+    if compactor, ok := adm.writer.(Compactor); ok {
+        err := compactor.compact(report)
+        if err != nil {
+            log.Println("finishDedup: could not compact output err:", err)
+        }
+    }
+
+    err := report.save(adm.config.Dedup.Report)
+    if err != nil {
+        log.Println("finishDedup: could not write report err:", err)
+        return
+    }
+    fmt.Println("finishDedup: dropped", report.Duplicates, "duplicate,", report.OutOfOrder, "out of order and", report.OutOfSlot, "out of slot readings, removed",
+        report.Compacted, "readings written again by this run. report written to", adm.config.Dedup.Report)
+}
+
 func (adm *ADMManager) processWindows() []*Window {
     var windows []*Window
     //1. Find minimum number free resources from workers and openIO
@@ -390,6 +537,11 @@ func (adm *ADMManager) processWindows() []*Window {
             end = length
         }
 
+        err := adm.client.breaker.waitUntilHealthy()
+        if err != nil {
+            log.Println("processWindows:", err)
+        }
+
         adm.workers.acquire()
         adm.openIO.acquire()
         wg.Add(1)
@@ -405,8 +557,10 @@ func (adm *ADMManager) processWindows() []*Window {
             if err != nil {
                 log.Println(err)
                 if !err.Fatal() {
-                    for _, uuid := range err.Failed() {
+                    for _, failed := range err.Failed() {
+                        uuid, cause := unwrapFailed(failed)
                         badUuid := uuid.(string)
+                        log.Println("processWindows:", queryErrorKind(cause), "failure for uuid:", badUuid)
                         errLog := newErrorLog(badUuid, WINDOW_ERROR, 0, 0)
                         adm.errorChan <- errLog
                     }
@@ -441,15 +595,45 @@ func (adm *ADMManager) processWindows() []*Window {
     return windows
 }
 
-func (adm *ADMManager) getTimeseriesDest() func() string {
-    fileCount := 0
-    return func() string {
+/* Runs the transform pipeline between a metadata reader and writer. Returns the
+ * channel the writer reads from and a channel delivering the pipeline's failures
+ * once it is done.
+ */
+func (adm *ADMManager) transformMetadata(dataChan chan *MetadataTuple) (chan *MetadataTuple, chan *ProcessError) {
+    result := make(chan *ProcessError, 1)
+    if adm.pipeline.empty() {
+        result <- nil
+        return dataChan, result
+    }
+
+    out := make(chan *MetadataTuple, CHANNEL_BUFFER_SIZE)
+    go func() {
+        result <- adm.pipeline.runMetadata(dataChan, out)
+    }()
+    return out, result
+}
+
+/* Like transformMetadata for timeseries data. */
+func (adm *ADMManager) transformTimeseries(dataChan chan *TimeseriesTuple) (chan *TimeseriesTuple, chan *ProcessError) {
+    result := make(chan *ProcessError, 1)
+    if adm.pipeline.empty() && !adm.pipeline.passesTimeseries() {
+        result <- nil
+        return dataChan, result
+    }
+
+    out := make(chan *TimeseriesTuple, CHANNEL_BUFFER_SIZE)
+    go func() {
+        result <- adm.pipeline.runTimeseries(dataChan, out)
+    }()
+    return out, result
+}
+
+/* Returns a function naming the destination of the next chunk of slots. */
+func (adm *ADMManager) getTimeseriesDest() func(slots []*TimeSlot) string {
+    return func(slots []*TimeSlot) string {
         switch adm.writeMode {
             case WM_FILE:
-                splt := strings.Split(adm.config.TimeseriesDest, ".")
-                dest := splt[0] + strconv.Itoa(fileCount) + splt[1]
-                fileCount++
-                return dest
+                return adm.chunks.next(slots[0].Uuid)
             case WM_GILES:
                 return adm.config.TimeseriesDest
             default:
@@ -485,18 +669,33 @@ func (adm *ADMManager) run() {
     }()
 
     adm.processUuids()
+    adm.pipeline.uuidRemapper().restore(adm.uuids, adm.log)
 
     var wg sync.WaitGroup
     wg.Add(2)
 
+    metadataDone := make(chan struct{})
     adm.workers.acquire()
     go func() {
         defer adm.workers.release()
         defer wg.Done()
+        defer close(metadataDone)
         adm.processMetadata()
         log.Println("run: metadata finished")
+        if remapper := adm.pipeline.uuidRemapper(); remapper != nil {
+            //after the metadata, which may set uuids
+            err := remapper.record(adm.uuids, adm.log)
+            if err != nil {
+                log.Println("run: could not record uuid mapping err:", err)
+            }
+        }
     }()
 
+    if adm.pipeline.needsMetadata() {
+        //transforms convert timeseries according to the metadata of their uuid
+        <-metadataDone
+    }
+
     adm.workers.acquire()
     go func() {
         defer adm.workers.release()
@@ -505,28 +704,82 @@ func (adm *ADMManager) run() {
         log.Println("run: timeseries finished")
     }()
     wg.Wait()
+    adm.finishQuality()
     close(adm.errorChan)
     log.Println("run: adm finished")
 }
 
-func main() {
-    admConfig, err := newAdmConfig()
+/* Writes the data quality report of the readings migrated by this run. */
+func (adm *ADMManager) finishQuality() {
+    analyzer := adm.pipeline.qualityAnalyzer()
+    if analyzer == nil {
+        return
+    }
+    if analyzer.readings() == 0 {
+        fmt.Println("finishQuality: no readings were migrated, no data quality report written")
+        return
+    }
+    report := analyzer.report()
+    err := report.save(adm.config.Quality)
     if err != nil {
-        if !fileExists(CONFIG_FILE) {
-            createConfigFile()
-            log.Println("No config file detected.\nNew config file created.")
-        } else {
-            log.Println("Bad config file.")
+        log.Println("finishQuality: could not write report err:", err)
+        return
+    }
+    fmt.Print(report.summary())
+    fmt.Println("finishQuality: report written to", adm.config.Quality.Report, "and", adm.config.Quality.Summary)
+}
+
+func main() {
+    if len(os.Args) > 1 && os.Args[1] == "verify" {
+        err := runVerify(os.Args[2:])
+        if err != nil {
+            log.Println("verify failed:", err)
+            os.Exit(1)
+        }
+        return
+    }
+    if len(os.Args) > 1 && os.Args[1] == "metadata-diff" {
+        err := runMetadataDiff(os.Args[2:])
+        if err != nil {
+            log.Println("metadata-diff failed:", err)
+            os.Exit(1)
         }
         return
     }
 
-    adm := newADMManager(admConfig)
+    admConfig, err := newAdmConfig(os.Args[1:])
+    if err != nil {
+        log.Println("Bad config:", err)
+        os.Exit(1)
+    }
+
+    if !fileExists(admConfig.configFile) {
+        createConfigFile(admConfig.configFile)
+        log.Println("No config file detected.\nNew config file created.")
+        return
+    }
+
+    fmt.Print("Effective configuration:\n", admConfig)
+    err = admConfig.validate()
+    if err != nil {
+        log.Println("Bad config:", err)
+        os.Exit(1)
+    }
+
+    adm, err := newADMManager(admConfig)
+    if err != nil {
+        log.Println("Could not start:", err)
+        os.Exit(1)
+    }
     go func() {
         for {
             time.Sleep(10 * time.Second)
             log.Println("Number of go routines:", runtime.NumGoroutine())
             log.Println("Number of workers:", adm.workers.count(), "Number of open IO:", adm.openIO.count())
+            log.Println("Timeseries reads:", adm.timeseriesReads.status())
+            log.Println("Timeseries bytes in flight:", adm.budget.inUse(), "of", adm.config.MemoryLimit)
+            log.Println("Source health:", adm.client.breaker.status())
+            log.Println("Source rate limit:", adm.client.limiter.status())
         }
     }()
 
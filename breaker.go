@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+type BreakerState uint8
+
+const (
+	BS_CLOSED BreakerState = iota + 1 //source healthy, queries flow
+	BS_OPEN                           //source down, queries wait for the next probe
+	BS_HALF_OPEN                      //a single probe query is in flight
+)
+
+/* Configures the circuit breaker shared by every query to the source. After
+ * failure_threshold consecutive failed queries the breaker opens and all queries
+ * wait. Every probe_interval a single waiting query is let through as a probe and
+ * the breaker closes again once one succeeds. Queries give up once the source
+ * has been down for longer than max_outage (0 waits forever).
+ */
+type BreakerConfig struct {
+	Enabled bool `yaml:"enabled"`
+	FailureThreshold int `yaml:"failure_threshold"`
+	ProbeInterval time.Duration `yaml:"probe_interval"`
+	MaxOutage time.Duration `yaml:"max_outage"`
+}
+
+type CircuitBreaker struct {
+	config BreakerConfig
+	mutex sync.Mutex
+	state BreakerState
+	consecutiveFailures int
+	outageStart time.Time
+	nextProbe time.Time
+	lastSuccess time.Time
+	lastFailure time.Time
+	trips int
+	resumed chan struct{} //closed when the breaker closes after an outage
+}
+
+func defaultBreakerConfig() BreakerConfig {
+	return BreakerConfig{
+		Enabled: true,
+		FailureThreshold: 5,
+		ProbeInterval: 30 * time.Second,
+		MaxOutage: 6 * time.Hour,
+	}
+}
+
+func newCircuitBreaker(config BreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		config: config,
+		state: BS_CLOSED,
+	}
+}
+
+/* Blocks until a query may be sent. Returns immediately while the source is
+ * healthy. While it is down, returns once the caller has been chosen as the probe
+ * or another probe has succeeded.
+ */
+func (b *CircuitBreaker) wait() error {
+	return b.block(true)
+}
+
+/* Blocks until the source is healthy without ever acting as the probe. Used to
+ * pause scheduling of new work during an outage.
+ */
+func (b *CircuitBreaker) waitUntilHealthy() error {
+	return b.block(false)
+}
+
+func (b *CircuitBreaker) block(probe bool) error {
+	if b == nil || !b.config.Enabled {
+		return nil
+	}
+
+	for {
+		b.mutex.Lock()
+		if b.state == BS_CLOSED {
+			b.mutex.Unlock()
+			return nil
+		}
+
+		if b.config.MaxOutage > 0 && time.Since(b.outageStart) > b.config.MaxOutage {
+			b.mutex.Unlock()
+			return fmt.Errorf("breaker: source unavailable for more than %v", b.config.MaxOutage)
+		}
+
+		now := time.Now()
+		if probe && b.state == BS_OPEN && !now.Before(b.nextProbe) {
+			b.state = BS_HALF_OPEN
+			b.mutex.Unlock()
+			log.Println("breaker: probing source")
+			return nil
+		}
+
+		delay := b.nextProbe.Sub(now)
+		if b.state == BS_HALF_OPEN || delay <= 0 {
+			delay = b.config.ProbeInterval
+		}
+		resumed := b.resumed
+		b.mutex.Unlock()
+
+		select {
+		case <-resumed:
+		case <-time.After(delay):
+		}
+	}
+}
+
+/* Records the outcome of a query. A query is healthy if the source answered it,
+ * even if the answer was an error that is not worth retrying.
+ */
+func (b *CircuitBreaker) record(healthy bool) {
+	if b == nil || !b.config.Enabled {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	if healthy {
+		if b.state != BS_CLOSED {
+			log.Println("breaker: source recovered after", now.Sub(b.outageStart))
+			close(b.resumed)
+		}
+		b.state = BS_CLOSED
+		b.consecutiveFailures = 0
+		b.lastSuccess = now
+		return
+	}
+
+	b.consecutiveFailures++
+	b.lastFailure = now
+	switch b.state {
+	case BS_HALF_OPEN:
+		b.state = BS_OPEN
+		b.nextProbe = now.Add(b.config.ProbeInterval)
+		log.Println("breaker: probe failed, next probe in", b.config.ProbeInterval)
+	case BS_CLOSED:
+		if b.consecutiveFailures >= b.config.FailureThreshold {
+			b.state = BS_OPEN
+			b.outageStart = now
+			b.nextProbe = now.Add(b.config.ProbeInterval)
+			b.resumed = make(chan struct{})
+			b.trips++
+			log.Println("breaker: source unavailable after", b.consecutiveFailures, "consecutive failures, pausing queries")
+		}
+	}
+}
+
+func (b *CircuitBreaker) isOpen() bool {
+	if b == nil || !b.config.Enabled {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.state != BS_CLOSED
+}
+
+/* Describes the health of the source for status output. */
+func (b *CircuitBreaker) status() string {
+	if b == nil || !b.config.Enabled {
+		return "source health not tracked"
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BS_CLOSED {
+		return fmt.Sprint("source healthy. outages: ", b.trips, " last success: ", b.lastSuccess.Format(time.RFC3339))
+	}
+	return fmt.Sprint("source unavailable for ", time.Since(b.outageStart).Truncate(time.Second),
+		". consecutive failures: ", b.consecutiveFailures, " next probe: ", b.nextProbe.Format(time.RFC3339))
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestBreaker() *CircuitBreaker {
+	return newCircuitBreaker(BreakerConfig{
+		Enabled: true,
+		FailureThreshold: 2,
+		ProbeInterval: 50 * time.Millisecond,
+	})
+}
+
+func TestBreakerTripsOnConsecutiveFailures(t *testing.T) {
+	b := newTestBreaker()
+	b.record(false)
+	b.record(true)
+	b.record(false)
+	if b.isOpen() {
+		t.Fatal("a success should reset the failure count")
+	}
+
+	b.record(false)
+	if !b.isOpen() {
+		t.Fatal("breaker should open after 2 consecutive failures")
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := newTestBreaker()
+	b.record(false)
+	b.record(false)
+
+	start := time.Now()
+	b.wait()
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("probe should wait for the probe interval")
+	}
+
+	probed := make(chan bool, 1)
+	go func() {
+		b.wait()
+		probed <- true
+	}()
+
+	select {
+	case <-probed:
+		t.Fatal("only one probe should be in flight")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	b.record(true)
+	select {
+	case <-probed:
+	case <-time.After(time.Second):
+		t.Fatal("waiting queries should resume once the probe succeeds")
+	}
+	if b.isOpen() {
+		t.Fatal("breaker should close after a successful probe")
+	}
+}
+
+func TestBreakerMaxOutage(t *testing.T) {
+	b := newTestBreaker()
+	b.config.MaxOutage = 10 * time.Millisecond
+	b.record(false)
+	b.record(false)
+
+	time.Sleep(20 * time.Millisecond)
+	if b.waitUntilHealthy() == nil {
+		t.Fatal("waiting should fail once the outage exceeds max_outage")
+	}
+}
+
+func TestQueryRequeuedDuringOutage(t *testing.T) {
+	server, calls := newTestServer([]int{503, 503, 503, 503, 200}, "[]")
+	defer server.Close()
+
+	policy := defaultRetryPolicy()
+	policy.BaseBackoff = time.Millisecond
+	client, _ := newQueryClient(policy, defaultEndpointConfig(), newTestBreaker(), nil, nil)
+
+	_, err := client.makeQuery(server.URL, "select distinct uuid")
+	if err != nil {
+		t.Fatal("query should wait out the outage instead of failing:", err)
+	}
+	if *calls != 5 {
+		t.Fatal("expected 5 calls but made", *calls)
+	}
+}
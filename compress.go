@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/* Compression codecs of output files */
+const (
+	CODEC_NONE = "none"
+	CODEC_GZIP = "gzip"
+	CODEC_ZSTD = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+/* Compression of files written by the FileWriter. Level 0 uses the codec's default.
+ * Appending to a compressed file adds a new gzip member or zstd frame, which
+ * readers of either format decode as one stream.
+ */
+type CompressionConfig struct {
+	Codec string `yaml:"codec"`
+	Level int `yaml:"level"`
+}
+
+func defaultCompressionConfig() CompressionConfig {
+	return CompressionConfig{
+		Codec: CODEC_NONE,
+	}
+}
+
+func (c *CompressionConfig) validate() error {
+	switch c.Codec {
+	case CODEC_NONE, "":
+	case CODEC_GZIP:
+		if c.Level != 0 && (c.Level < gzip.HuffmanOnly || c.Level > gzip.BestCompression) {
+			return fmt.Errorf("compression.level must be between %d and %d for gzip", gzip.HuffmanOnly, gzip.BestCompression)
+		}
+	case CODEC_ZSTD:
+		if c.Level < 0 || c.Level > 22 {
+			return fmt.Errorf("compression.level must be between 1 and 22 for zstd")
+		}
+	default:
+		return fmt.Errorf("compression.codec must be one of %s, %s or %s", CODEC_NONE, CODEC_GZIP, CODEC_ZSTD)
+	}
+	return nil
+}
+
+/* Returns the file extension of the codec, e.g. ".gz". */
+func (c *CompressionConfig) extension() string {
+	switch c.Codec {
+	case CODEC_GZIP:
+		return ".gz"
+	case CODEC_ZSTD:
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+/* Wraps w so everything written to it is compressed. Closing the returned writer
+ * flushes it but does not close w.
+ */
+func (c *CompressionConfig) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case CODEC_GZIP:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case CODEC_ZSTD:
+		level := zstd.SpeedDefault
+		if c.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(c.Level)
+		}
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+/* Opens path for reading, transparently decompressing gzip and zstd files.
+ * The codec is detected from the contents, not the file name.
+ */
+func openDecompressed(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := newDecompressedReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &decompressedFile{ReadCloser: reader, file: f}, nil
+}
+
+/* Like ioutil.ReadFile but decompresses gzip and zstd files. */
+func readDecompressedFile(path string) ([]byte, error) {
+	f, err := openDecompressed(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+func newDecompressedReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, _ := buffered.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, zstdMagic):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(buffered), nil
+	}
+}
+
+type decompressedFile struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (f *decompressedFile) Close() error {
+	f.ReadCloser.Close()
+	return f.file.Close()
+}
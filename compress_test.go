@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const (
+	TEST_COMPRESSED = "test_compressed"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	for _, codec := range []string{CODEC_NONE, CODEC_GZIP, CODEC_ZSTD} {
+		compression := CompressionConfig{Codec: codec, Level: 3}
+		dest := TEST_COMPRESSED + compression.extension()
+		w := newFileWriter(compression, nil)
+
+		dataChan := make(chan *MetadataTuple, 2)
+		dataChan <- makeMetadataTuple([]string{"a"}, []byte(`{"uuid":"a"}`))
+		close(dataChan)
+		processErr := w.writeMetadata(dest, dataChan)
+		if processErr != nil {
+			t.Fatal(codec, processErr)
+		}
+
+		f, err := w.openFile(dest, os.O_APPEND|os.O_WRONLY)
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		f.Write([]byte(`{"uuid":"b"}`))
+		f.Close()
+
+		raw, _ := ioutil.ReadFile(dest)
+		body, readErr := readDecompressedFile(dest)
+		os.Remove(dest)
+		if readErr != nil {
+			t.Fatal(codec, readErr)
+		}
+		if string(body) != `[{"uuid":"a"}]{"uuid":"b"}` {
+			t.Fatal(codec, "appended writes not read back:", string(body))
+		}
+		if codec != CODEC_NONE && string(raw) == string(body) {
+			t.Fatal(codec, "file was not compressed")
+		}
+	}
+}
+
+func TestCompressionValidate(t *testing.T) {
+	bad := []CompressionConfig{{Codec: "lz4"}, {Codec: CODEC_GZIP, Level: 10}, {Codec: CODEC_ZSTD, Level: 23}}
+	for _, c := range bad {
+		if c.validate() == nil {
+			t.Fatal("expected", c, "to be rejected")
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+/* Configures the number of concurrent timeseries reads. When adaptive, the limit
+ * starts at initial and is adjusted after every window of observed queries: it
+ * grows by one while the reads are saturating the limit with average latency
+ * under target_latency and error rate under max_error_rate, and is multiplied
+ * by decrease_factor otherwise. max defaults to worker_size and initial to open_io.
+ * When not adaptive the limit stays at initial.
+ */
+type ConcurrencyConfig struct {
+	Adaptive bool `yaml:"adaptive"`
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+	Initial int `yaml:"initial"`
+	TargetLatency time.Duration `yaml:"target_latency"`
+	MaxErrorRate float64 `yaml:"max_error_rate"`
+	Window int `yaml:"window"`
+	DecreaseFactor float64 `yaml:"decrease_factor"`
+}
+
+/* Semaphore whose capacity follows an AIMD controller fed by query outcomes. */
+type AdaptiveSema struct {
+	config ConcurrencyConfig
+	mutex sync.Mutex
+	cond *sync.Cond
+	limit int
+	inUse int
+	saturated bool
+	samples int
+	failures int
+	latency time.Duration
+}
+
+func defaultConcurrencyConfig() ConcurrencyConfig {
+	return ConcurrencyConfig{
+		Adaptive: true,
+		Min: 1,
+		TargetLatency: 10 * time.Second,
+		MaxErrorRate: 0.1,
+		Window: 20,
+		DecreaseFactor: 0.5,
+	}
+}
+
+/* Fills in max and initial from the fixed worker_size and open_io bounds. */
+func (c ConcurrencyConfig) withDefaults(workerSize int, openIO int) ConcurrencyConfig {
+	if c.Max <= 0 {
+		c.Max = workerSize
+	}
+	if c.Initial <= 0 {
+		c.Initial = openIO
+	}
+	if c.Min < 1 {
+		c.Min = 1
+	}
+	if c.Initial > c.Max {
+		c.Initial = c.Max
+	}
+	if c.Initial < c.Min {
+		c.Initial = c.Min
+	}
+	return c
+}
+
+func newAdaptiveSema(config ConcurrencyConfig) *AdaptiveSema {
+	s := &AdaptiveSema{
+		config: config,
+		limit: config.Initial,
+	}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *AdaptiveSema) acquire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for s.inUse >= s.limit {
+		s.saturated = true
+		s.cond.Wait()
+	}
+	s.inUse++
+	if s.inUse >= s.limit {
+		s.saturated = true
+	}
+}
+
+func (s *AdaptiveSema) release() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.inUse > 0 {
+		s.inUse--
+	}
+	s.cond.Signal()
+}
+
+/* Records the latency and outcome of one query against the source. */
+func (s *AdaptiveSema) observe(latency time.Duration, failed bool) {
+	if s == nil || !s.config.Adaptive {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.samples++
+	s.latency += latency
+	if failed {
+		s.failures++
+	}
+	if s.samples < s.config.Window {
+		return
+	}
+
+	errorRate := float64(s.failures) / float64(s.samples)
+	average := s.latency / time.Duration(s.samples)
+	previous := s.limit
+	if errorRate > s.config.MaxErrorRate || (s.config.TargetLatency > 0 && average > s.config.TargetLatency) {
+		s.limit = int(float64(s.limit) * s.config.DecreaseFactor)
+		if s.limit < s.config.Min {
+			s.limit = s.config.Min
+		}
+	} else if s.saturated && s.limit < s.config.Max {
+		s.limit++
+		s.cond.Broadcast()
+	}
+
+	if s.limit != previous {
+		log.Println("concurrency: read limit", previous, "->", s.limit, "average latency:", average, "error rate:", errorRate)
+	}
+	s.samples, s.failures, s.latency, s.saturated = 0, 0, 0, s.inUse >= s.limit
+}
+
+func (s *AdaptiveSema) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.inUse
+}
+
+func (s *AdaptiveSema) currentLimit() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.limit
+}
+
+func (s *AdaptiveSema) status() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mode := "fixed"
+	if s.config.Adaptive {
+		mode = "adaptive"
+	}
+	return fmt.Sprint(s.inUse, " of ", s.limit, " (", mode, ", ", s.config.Min, "-", s.config.Max, ")")
+}
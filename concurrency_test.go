@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestAdaptiveSema() *AdaptiveSema {
+	config := defaultConcurrencyConfig()
+	config.Window = 4
+	config.TargetLatency = time.Second
+	return newAdaptiveSema(config.withDefaults(8, 2))
+}
+
+func TestConcurrencyDefaults(t *testing.T) {
+	config := defaultConcurrencyConfig().withDefaults(40, 10)
+	if config.Max != 40 || config.Initial != 10 {
+		t.Fatal("max and initial should default to worker_size and open_io:", config)
+	}
+}
+
+func TestConcurrencyGrowsWhenHealthy(t *testing.T) {
+	s := newTestAdaptiveSema()
+	s.acquire()
+	s.acquire()
+	for i := 0; i < 4; i++ {
+		s.observe(10*time.Millisecond, false)
+	}
+	if s.currentLimit() != 3 {
+		t.Fatal("saturated healthy reads should grow the limit to 3 but it is", s.currentLimit())
+	}
+}
+
+func TestConcurrencyDoesNotGrowWhenIdle(t *testing.T) {
+	s := newTestAdaptiveSema()
+	for i := 0; i < 4; i++ {
+		s.observe(10*time.Millisecond, false)
+	}
+	if s.currentLimit() != 2 {
+		t.Fatal("an unsaturated limit should not grow but it is", s.currentLimit())
+	}
+}
+
+func TestConcurrencyShrinksOnErrorsAndLatency(t *testing.T) {
+	s := newTestAdaptiveSema()
+	s.limit = 8
+	for i := 0; i < 4; i++ {
+		s.observe(10*time.Millisecond, i%2 == 0)
+	}
+	if s.currentLimit() != 4 {
+		t.Fatal("errors should halve the limit to 4 but it is", s.currentLimit())
+	}
+
+	for i := 0; i < 4; i++ {
+		s.observe(2*time.Second, false)
+	}
+	if s.currentLimit() != 2 {
+		t.Fatal("slow reads should halve the limit to 2 but it is", s.currentLimit())
+	}
+
+	for j := 0; j < 3; j++ {
+		for i := 0; i < 4; i++ {
+			s.observe(2*time.Second, true)
+		}
+	}
+	if s.currentLimit() != 1 {
+		t.Fatal("the limit should not go below min but it is", s.currentLimit())
+	}
+}
+
+func TestConcurrencyAcquireBlocksAtLimit(t *testing.T) {
+	s := newTestAdaptiveSema()
+	s.acquire()
+	s.acquire()
+
+	acquired := make(chan bool, 1)
+	go func() {
+		s.acquire()
+		acquired <- true
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.release()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("release should unblock a waiting acquire")
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DEDUP_REPORT = "dev/dedup_report.json"
+	COMPACT_BATCH_READINGS = 10000 //readings per batch when rewriting a chunk file
+)
+
+/* Guarantees each (uuid, timestamp) is written once, in time order. A slot owns
+ * the readings in [start, end), so a reading on the boundary of two slots returned
+ * by both is kept only by the later one. The report counts the readings dropped.
+ */
+type DedupConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Report string `yaml:"report"`
+}
+
+func defaultDedupConfig() DedupConfig {
+	return DedupConfig{
+		Enabled: true,
+		Report: DEDUP_REPORT,
+	}
+}
+
+type DedupCounts struct {
+	Duplicates int64 `json:"duplicates"`   //readings at the timestamp of the last one written for the slot
+	OutOfOrder int64 `json:"out_of_order"` //readings older than the last one written for the slot
+	OutOfSlot int64 `json:"out_of_slot"`   //readings outside the slot's [start, end)
+}
+
+/* Slot written by an earlier run and removed from its chunk file because a later
+ * run wrote it again.
+ */
+type CompactedSlot struct {
+	File string `json:"file"`
+	Uuid string `json:"uuid"`
+	StartTime int64 `json:"start_time"`
+	EndTime int64 `json:"end_time"`
+	Readings int64 `json:"readings"`
+}
+
+type DedupReport struct {
+	Duplicates int64 `json:"duplicates"`
+	OutOfOrder int64 `json:"out_of_order"`
+	OutOfSlot int64 `json:"out_of_slot"`
+	Reordered int64 `json:"reordered_batches"` //batches sorted into time order
+	Compacted int64 `json:"compacted_readings"`
+	Uuids map[string]*DedupCounts `json:"uuids"` //uuids with dropped readings
+	CompactedSlots []*CompactedSlot `json:"compacted_slots"`
+
+	mutex sync.Mutex
+}
+
+func newDedupReport() *DedupReport {
+	return &DedupReport{Uuids: make(map[string]*DedupCounts)}
+}
+
+func (r *DedupReport) count(uuid string, duplicates int64, outOfOrder int64, outOfSlot int64, reordered bool) {
+	if duplicates == 0 && outOfOrder == 0 && outOfSlot == 0 && !reordered {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if reordered {
+		r.Reordered++
+	}
+	if duplicates == 0 && outOfOrder == 0 && outOfSlot == 0 {
+		return
+	}
+	counts, ok := r.Uuids[uuid]
+	if !ok {
+		counts = &DedupCounts{}
+		r.Uuids[uuid] = counts
+	}
+	counts.Duplicates += duplicates
+	counts.OutOfOrder += outOfOrder
+	counts.OutOfSlot += outOfSlot
+	r.Duplicates += duplicates
+	r.OutOfOrder += outOfOrder
+	r.OutOfSlot += outOfSlot
+}
+
+func (r *DedupReport) compacted(slot *CompactedSlot) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Compacted += slot.Readings
+	r.CompactedSlots = append(r.CompactedSlots, slot)
+}
+
+func (r *DedupReport) save(path string) error {
+	r.mutex.Lock()
+	body, err := json.MarshalIndent(r, "", "  ")
+	r.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(path), os.ModePerm)
+	return writeFileAtomic(path, body)
+}
+
+type Deduplicator struct {
+	report *DedupReport
+}
+
+func newDeduplicator() *Deduplicator {
+	return &Deduplicator{report: newDedupReport()}
+}
+
+type dedupKey struct {
+	slot *TimeSlot
+	uuid string
+}
+
+/* Deduplication state of one stream of tuples: the last timestamp written per slot.
+ * Readers emit a slot's readings in time order, so a reading at the last timestamp
+ * repeats it, e.g. in a stream retried after part of it was emitted, and one
+ * before it arrived out of order. Both are dropped, keeping the first reading of
+ * each timestamp and the slot in time order, and counted apart in the report.
+ */
+type Dedup struct {
+	deduplicator *Deduplicator
+	last map[dedupKey]int64
+}
+
+func (d *Deduplicator) start() *Dedup {
+	return &Dedup{deduplicator: d, last: make(map[dedupKey]int64)}
+}
+
+/* Drops repeated, out of order and out of slot readings from the tuple in place. */
+func (d *Dedup) add(tuple *TimeseriesTuple) error {
+	var timeseries []*TimeseriesData
+	err := json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return err
+	}
+
+	var kept []*TimeseriesData
+	readings := 0
+	for _, data := range timeseries {
+		times := make([]int64, len(data.Readings))
+		for i, reading := range data.Readings {
+			times[i], err = readingTime(reading)
+			if err != nil {
+				return err
+			}
+		}
+
+		reordered := !sort.SliceIsSorted(times, func(i, j int) bool { return times[i] < times[j] })
+		if reordered {
+			sort.Stable(byReadingTime{times, data.Readings})
+		}
+
+		key := dedupKey{tuple.slot, data.Uuid}
+		last, seen := d.last[key]
+		var duplicates, outOfOrder, outOfSlot int64
+		filtered := data.Readings[:0]
+		for i, reading := range data.Readings {
+			t := times[i]
+			switch {
+			case t < tuple.slot.StartTime || (tuple.slot.EndTime != -1 && t >= tuple.slot.EndTime):
+				outOfSlot++
+				continue
+			case seen && t == last:
+				duplicates++
+				continue
+			case seen && t < last:
+				outOfOrder++
+				continue
+			}
+			filtered = append(filtered, reading)
+			last = t
+			seen = true
+		}
+		if seen {
+			d.last[key] = last
+		}
+		d.deduplicator.report.count(data.Uuid, duplicates, outOfOrder, outOfSlot, reordered)
+
+		data.Readings = filtered
+		if len(filtered) > 0 {
+			kept = append(kept, data)
+			readings += len(filtered)
+		}
+	}
+
+	tuple.data, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	tuple.readings = int64(readings)
+	return nil
+}
+
+/* Sorts readings by their parsed timestamps. */
+type byReadingTime struct {
+	times []int64
+	readings [][]json.RawMessage
+}
+
+func (b byReadingTime) Len() int {
+	return len(b.times)
+}
+
+func (b byReadingTime) Less(i, j int) bool {
+	return b.times[i] < b.times[j]
+}
+
+func (b byReadingTime) Swap(i, j int) {
+	b.times[i], b.times[j] = b.times[j], b.times[i]
+	b.readings[i], b.readings[j] = b.readings[j], b.readings[i]
+}
+
+/* Writers that can remove slots written more than once across runs. */
+type Compactor interface {
+	compact(report *DedupReport) error
+}
+
+/* Removes the other copies of slots written again by a later run, e.g. after a
+ * partial write or a requeue by adm verify, keeping the copy of the latest run
+ * that wrote the slot completely. Slots without a complete copy are left alone,
+ * so a run failing part way through a slot never costs the readings of an earlier
+ * one. Readings of one slot spread over several files by the same run are kept.
+ */
+func (w *FileWriter) compact(report *DedupReport) error {
+	if w.chunks == nil {
+		return nil
+	}
+	manifest := w.chunks.manifest
+	manifest.mutex.Lock()
+	defer manifest.mutex.Unlock()
+
+	latest := make(map[slotKey]string)
+	for _, chunk := range manifest.Chunks {
+		for _, slot := range chunk.Slots {
+			if slot.Complete {
+				latest[slotKey{slot.Uuid, slot.StartTime, slot.EndTime}] = chunk.Run
+			}
+		}
+	}
+
+	changed := false
+	for _, chunk := range manifest.Chunks {
+		drop := make(map[string][]*ManifestSlot)
+		var kept []*ManifestSlot
+		for _, slot := range chunk.Slots {
+			run, ok := latest[slotKey{slot.Uuid, slot.StartTime, slot.EndTime}]
+			if ok && run != chunk.Run {
+				drop[slot.Uuid] = append(drop[slot.Uuid], slot)
+			} else {
+				kept = append(kept, slot)
+			}
+		}
+		if len(drop) == 0 {
+			continue
+		}
+
+		log.Println("compact: removing slots written again by a later run from", chunk.File)
+		err := w.rewriteChunk(chunk, drop, report)
+		if err != nil {
+			return fmt.Errorf("compact: could not rewrite %s err: %v", chunk.File, err)
+		}
+		chunk.Slots = kept
+		changed = true
+	}
+
+	if !changed {
+		return nil
+	}
+	return manifest.save()
+}
+
+type slotKey struct {
+	uuid string
+	start int64
+	end int64
+}
+
+/* Rewrites a chunk file without the readings of the slots in drop. */
+func (w *FileWriter) rewriteChunk(chunk *ManifestChunk, drop map[string][]*ManifestSlot, report *DedupReport) error {
+	tmp := chunk.File + ".tmp"
+	f, err := w.openFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	first := true
+	var batch *TimeseriesData
+	flush := func() error {
+		if batch == nil {
+			return nil
+		}
+		body, err := json.Marshal([]*TimeseriesData{batch})
+		if err != nil {
+			return err
+		}
+		if !first {
+			body = append([]byte(","), body...)
+		}
+		first = false
+		batch = nil
+		_, err = f.Write(body)
+		return err
+	}
+
+	removed := make(map[*ManifestSlot]int64)
+	_, err = f.Write([]byte("["))
+	if err == nil {
+		err = scanTimeseriesFile(chunk.File, chunk.TimeFormat, func(uuid string, t int64, reading []json.RawMessage) error {
+			for _, slot := range drop[uuid] {
+				if t >= slot.StartTime && (slot.EndTime == -1 || t < slot.EndTime) {
+					removed[slot]++
+					return nil
+				}
+			}
+
+			if batch != nil && (batch.Uuid != uuid || len(batch.Readings) >= COMPACT_BATCH_READINGS) {
+				err = flush()
+				if err != nil {
+					return err
+				}
+			}
+			if batch == nil {
+				batch = &TimeseriesData{Uuid: uuid}
+			}
+			batch.Readings = append(batch.Readings, reading)
+			return nil
+		})
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		_, err = f.Write([]byte("]"))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	err = os.Rename(tmp, chunk.File)
+	if err != nil {
+		return err
+	}
+	chunk.Bytes, chunk.Sha256, err = fileDigest(chunk.File)
+	if err != nil {
+		return err
+	}
+
+	for _, slots := range drop {
+		for _, slot := range slots {
+			chunk.Readings -= removed[slot]
+			report.compacted(&CompactedSlot{
+				File: chunk.File,
+				Uuid: slot.Uuid,
+				StartTime: slot.StartTime,
+				EndTime: slot.EndTime,
+				Readings: removed[slot],
+			})
+		}
+	}
+	return nil
+}
+
+/* Identifies the chunk files written by one run of adm in the manifest. */
+func newRunId() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDedupDropsRepeatedReadings(t *testing.T) {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	pipeline.deduplicate()
+
+	slot := &TimeSlot{Uuid: "a", StartTime: 10, EndTime: 20}
+	written := runTestTimeseries(pipeline,
+		makeTimeseriesTuple(slot, []byte(`[{"uuid":"a","Readings":[[12,2],[11,1],[20,9]]}]`)),
+		makeTimeseriesTuple(slot, []byte(`[{"uuid":"a","Readings":[[11,5],[11,1],[12,2],[13,3],[13,4]]}]`)),
+	)
+	if len(written) != 2 || written[0] != `[{"uuid":"a","Readings":[[11,1],[12,2]]}]` || written[1] != `[{"uuid":"a","Readings":[[13,3]]}]` {
+		t.Fatal("unexpected readings:", written)
+	}
+
+	report := pipeline.deduplicator.report
+	if report.Duplicates != 2 || report.OutOfOrder != 2 || report.OutOfSlot != 1 || report.Reordered != 1 || report.Uuids["a"].Duplicates != 2 {
+		t.Fatal("unexpected report:", report)
+	}
+}
+
+func TestDedupCompactsEarlierRuns(t *testing.T) {
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+
+	chunks, err := newChunkFiles(defaultOutputConfig(), TEST_OUTPUT_DIR+"/ts.json", defaultCompressionConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newFileWriter(defaultCompressionConfig(), chunks)
+
+	write := func(run string, complete bool, tuples ...*TimeseriesTuple) string {
+		chunks.run = run
+		dataChan := make(chan *TimeseriesTuple, len(tuples))
+		for _, tuple := range tuples {
+			tuple.readings = 1
+			dataChan <- tuple
+		}
+		close(dataChan)
+		dest := chunks.next(tuples[0].slot.Uuid)
+		if processErr := w.writeTimeseriesData(dest, dataChan); processErr != nil {
+			t.Fatal(processErr)
+		}
+		if complete {
+			slots := make([]*TimeSlot, 0)
+			for _, tuple := range tuples {
+				slots = append(slots, tuple.slot)
+			}
+			if err := chunks.markComplete(slots); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return dest
+	}
+
+	partial := &TimeSlot{Uuid: "a", StartTime: 0, EndTime: 10}
+	done := &TimeSlot{Uuid: "b", StartTime: 0, EndTime: 10}
+	failed := &TimeSlot{Uuid: "c", StartTime: 0, EndTime: 10}
+	first := write("1", true,
+		makeTimeseriesTuple(partial, []byte(`[{"uuid":"a","Readings":[[1,1]]}]`)),
+		makeTimeseriesTuple(done, []byte(`[{"uuid":"b","Readings":[[1,1]]}]`)),
+		makeTimeseriesTuple(failed, []byte(`[{"uuid":"c","Readings":[[1,1]]}]`)))
+	write("2", true, makeTimeseriesTuple(partial, []byte(`[{"uuid":"a","Readings":[[1,1]]}]`)))
+	write("3", false, makeTimeseriesTuple(failed, []byte(`[{"uuid":"c","Readings":[[1,1]]}]`)))
+
+	report := newDedupReport()
+	err = w.compact(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := ioutil.ReadFile(first)
+	if err != nil || string(body) != `[[{"uuid":"b","Readings":[[1,1]]}],[{"uuid":"c","Readings":[[1,1]]}]]` {
+		t.Fatal("the slot written again should be removed from the first run's file:", string(body), err)
+	}
+	chunk := chunks.manifest.Chunks[0]
+	if report.Compacted != 2 || len(chunk.Slots) != 2 || chunk.Slots[0].Uuid != "b" || chunk.Readings != 2 {
+		t.Fatal("unexpected compaction:", report.Compacted, chunk.Slots, chunk.Readings)
+	}
+	if len(chunks.manifest.Chunks[2].Slots) != 0 {
+		t.Fatal("a partial copy should give way to the earlier complete one:", chunks.manifest.Chunks[2].Slots)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Aggregates a bucket can be reduced to */
+const (
+	AGG_MEAN = "mean"
+	AGG_MIN = "min"
+	AGG_MAX = "max"
+	AGG_COUNT = "count"
+	AGG_LAST = "last"
+)
+
+const (
+	RESOLUTION_FIELD = "Metadata/Downsample/Resolution"
+	AGGREGATES_FIELD = "Metadata/Downsample/Aggregates"
+	SLOT_WIDTH = 365 * 24 * time.Hour //WINDOW_WIDTH. buckets must divide it so no bucket spans two slots.
+)
+
+/* Columns of a reading returned by a Giles statistical query, after the timestamp. */
+var statisticalColumns = map[string]int{
+	AGG_COUNT: 1,
+	AGG_MIN: 2,
+	AGG_MEAN: 3,
+	AGG_MAX: 4,
+}
+
+/* Reduces the readings of each uuid to one reading per bucket of fixed width,
+ * [bucket start, aggregate, ...] with one value per aggregate in order. An empty
+ * bucket disables downsampling. With pushdown the source computes the aggregates
+ * with a statistical query instead of adm.
+ */
+type DownsampleConfig struct {
+	Bucket string `yaml:"bucket"` //e.g. 1min, 15min, 1h
+	Aggregates []string `yaml:"aggregates"`
+	Pushdown bool `yaml:"pushdown"`
+}
+
+func defaultDownsampleConfig() DownsampleConfig {
+	return DownsampleConfig{
+		Aggregates: []string{AGG_MEAN},
+	}
+}
+
+func (c *DownsampleConfig) enabled() bool {
+	return c.Bucket != ""
+}
+
+/* Parses the bucket width, accepting "min" for minutes. */
+func (c *DownsampleConfig) width() (time.Duration, error) {
+	return time.ParseDuration(strings.Replace(c.Bucket, "min", "m", 1))
+}
+
+func (c *DownsampleConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	width, err := c.width()
+	if err != nil {
+		return fmt.Errorf("downsample.bucket: %v", err)
+	}
+	if width < time.Second || width%time.Second != 0 || SLOT_WIDTH%width != 0 {
+		return fmt.Errorf("downsample.bucket must be a whole number of seconds dividing 365 days, e.g. 1min, 15min or 1h")
+	}
+	if len(c.Aggregates) == 0 {
+		return fmt.Errorf("downsample.aggregates can not be empty")
+	}
+	seen := make(map[string]bool)
+	for _, aggregate := range c.Aggregates {
+		switch aggregate {
+		case AGG_MEAN, AGG_MIN, AGG_MAX, AGG_COUNT, AGG_LAST:
+		default:
+			return fmt.Errorf("downsample.aggregates: unknown aggregate %q", aggregate)
+		}
+		if seen[aggregate] {
+			return fmt.Errorf("downsample.aggregates: %s is listed twice", aggregate)
+		}
+		seen[aggregate] = true
+		if _, ok := statisticalColumns[aggregate]; c.Pushdown && !ok {
+			return fmt.Errorf("downsample.aggregates: %s can not be pushed down to the source", aggregate)
+		}
+	}
+	return nil
+}
+
+/* Width of a statistical query, e.g. "900s". */
+func (c *DownsampleConfig) queryWidth() string {
+	width, _ := c.width()
+	return strconv.FormatInt(int64(width/time.Second), 10) + "s"
+}
+
+/* Notes the resolution in the metadata of downsampled streams. The readings are
+ * aggregated by the pipeline, which keeps buckets open across tuples.
+ */
+type Downsampler struct {
+	config DownsampleConfig
+	width int64
+}
+
+func newDownsampler(config DownsampleConfig) (*Downsampler, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	width, _ := config.width()
+	return &Downsampler{config: config, width: int64(width)}, nil
+}
+
+func (d *Downsampler) metadata(record *Metadata) (*Metadata, error) {
+	err := record.set(RESOLUTION_FIELD, d.config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	err = record.set(AGGREGATES_FIELD, strings.Join(d.config.Aggregates, ","))
+	if err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func (d *Downsampler) timeseries(data *TimeseriesData) (*TimeseriesData, error) {
+	return data, nil
+}
+
+/* A bucket being filled with the readings of one uuid. */
+type bucket struct {
+	slot *TimeSlot
+	start int64
+	count int64
+	sum float64
+	min float64
+	max float64
+	last json.RawMessage
+}
+
+func (b *bucket) add(value float64, raw json.RawMessage) {
+	if b.count == 0 || value < b.min {
+		b.min = value
+	}
+	if b.count == 0 || value > b.max {
+		b.max = value
+	}
+	b.count++
+	b.sum += value
+	b.last = raw
+}
+
+func formatFloat(value float64) json.RawMessage {
+	return json.RawMessage(strconv.FormatFloat(value, 'f', -1, 64))
+}
+
+/* Downsampling state of one stream of tuples. Readings of a uuid are expected in
+ * time order, as the reader emits them.
+ */
+type Aggregation struct {
+	downsampler *Downsampler
+	open map[string]*bucket
+}
+
+func (d *Downsampler) start() *Aggregation {
+	return &Aggregation{downsampler: d, open: make(map[string]*bucket)}
+}
+
+func (a *Aggregation) row(b *bucket) []json.RawMessage {
+	row := []json.RawMessage{json.RawMessage(strconv.FormatInt(b.start, 10))}
+	for _, aggregate := range a.downsampler.config.Aggregates {
+		switch aggregate {
+		case AGG_MEAN:
+			row = append(row, formatFloat(b.sum/float64(b.count)))
+		case AGG_MIN:
+			row = append(row, formatFloat(b.min))
+		case AGG_MAX:
+			row = append(row, formatFloat(b.max))
+		case AGG_COUNT:
+			row = append(row, json.RawMessage(strconv.FormatInt(b.count, 10)))
+		case AGG_LAST:
+			row = append(row, b.last)
+		}
+	}
+	return row
+}
+
+/* Aggregates the tuple in place, keeping the last bucket of each uuid open in case
+ * the next tuple continues it. Returns tuples holding the buckets of other slots,
+ * which are complete once the reader has moved on, to send before this one.
+ */
+func (a *Aggregation) add(tuple *TimeseriesTuple) ([]*TimeseriesTuple, error) {
+	var timeseries []*TimeseriesData
+	err := json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return nil, err
+	}
+
+	var flushed []*TimeseriesTuple
+	if !a.downsampler.config.Pushdown {
+		flushed, err = a.flush(tuple.slot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var kept []*TimeseriesData
+	readings := 0
+	for _, data := range timeseries {
+		if a.downsampler.config.Pushdown {
+			data.Readings, err = a.columns(data)
+		} else {
+			data.Readings, err = a.aggregate(tuple.slot, data)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(data.Readings) > 0 {
+			kept = append(kept, data)
+			readings += len(data.Readings)
+		}
+	}
+
+	tuple.data, err = json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	tuple.readings = int64(readings)
+	return flushed, nil
+}
+
+/* Folds readings into buckets, returning the buckets completed by this data. */
+func (a *Aggregation) aggregate(slot *TimeSlot, data *TimeseriesData) ([][]json.RawMessage, error) {
+	var rows [][]json.RawMessage
+	open := a.open[data.Uuid]
+	for _, reading := range data.Readings {
+		t, err := readingTime(reading)
+		if err != nil {
+			return nil, err
+		}
+		if len(reading) < 2 || string(reading[1]) == "null" {
+			continue
+		}
+		value, err := strconv.ParseFloat(string(reading[1]), 64)
+		if err != nil || math.IsNaN(value) {
+			return nil, fmt.Errorf("reading %s of uuid %s is not a number", string(reading[1]), data.Uuid)
+		}
+
+		start := t - t%a.downsampler.width
+		if open != nil && open.start != start {
+			rows = append(rows, a.row(open))
+			open = nil
+		}
+		if open == nil {
+			open = &bucket{slot: slot, start: start}
+		}
+		open.add(value, reading[1])
+	}
+
+	if open != nil {
+		a.open[data.Uuid] = open
+	}
+	return rows, nil
+}
+
+/* Picks the configured aggregates out of the rows of a statistical query. */
+func (a *Aggregation) columns(data *TimeseriesData) ([][]json.RawMessage, error) {
+	rows := make([][]json.RawMessage, 0, len(data.Readings))
+	for _, reading := range data.Readings {
+		if len(reading) == 0 {
+			continue
+		}
+		row := []json.RawMessage{reading[0]}
+		for _, aggregate := range a.downsampler.config.Aggregates {
+			column := statisticalColumns[aggregate]
+			if column >= len(reading) {
+				return nil, fmt.Errorf("statistical reading of uuid %s has no %s", data.Uuid, aggregate)
+			}
+			row = append(row, reading[column])
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+/* Closes the open buckets of every slot other than keep, one tuple per slot. */
+func (a *Aggregation) flush(keep *TimeSlot) ([]*TimeseriesTuple, error) {
+	bySlot := make(map[*TimeSlot][]*TimeseriesData)
+	var slots []*TimeSlot
+	for uuid, open := range a.open {
+		if open.slot == keep {
+			continue
+		}
+		if _, ok := bySlot[open.slot]; !ok {
+			slots = append(slots, open.slot)
+		}
+		bySlot[open.slot] = append(bySlot[open.slot], &TimeseriesData{Uuid: uuid, Readings: [][]json.RawMessage{a.row(open)}})
+		delete(a.open, uuid)
+	}
+
+	var tuples []*TimeseriesTuple
+	for _, slot := range slots {
+		data, err := json.Marshal(bySlot[slot])
+		if err != nil {
+			return nil, err
+		}
+		tuple := makeTimeseriesTuple(slot, data)
+		tuple.readings = int64(len(bySlot[slot]))
+		tuples = append(tuples, tuple)
+	}
+	return tuples, nil
+}
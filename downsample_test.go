@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+func runTestTimeseries(pipeline *Pipeline, tuples ...*TimeseriesTuple) []string {
+	in := make(chan *TimeseriesTuple, len(tuples))
+	out := make(chan *TimeseriesTuple, 2*len(tuples)+1)
+	for _, tuple := range tuples {
+		in <- tuple
+	}
+	close(in)
+	pipeline.runTimeseries(in, out)
+
+	var written []string
+	for tuple := range out {
+		written = append(written, string(tuple.data))
+	}
+	return written
+}
+
+func TestDownsampleAcrossTuples(t *testing.T) {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	err := pipeline.downsample(DownsampleConfig{Bucket: "1min", Aggregates: []string{"mean", "min", "max", "count", "last"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, second := &TimeSlot{Uuid: "a"}, &TimeSlot{Uuid: "b"}
+	written := runTestTimeseries(pipeline,
+		makeTimeseriesTuple(first, []byte(`[{"uuid":"a","Readings":[[0,1],[30000000000,2],[60000000000,4]]}]`)),
+		makeTimeseriesTuple(first, []byte(`[{"uuid":"a","Readings":[[90000000000,null],[100000000000,6]]}]`)),
+		makeTimeseriesTuple(second, []byte(`[{"uuid":"b","Readings":[[5,7]]}]`)),
+	)
+
+	expected := []string{
+		`[{"uuid":"a","Readings":[[0,1.5,1,2,2,2]]}]`,
+		`[{"uuid":"a","Readings":[[60000000000,5,4,6,2,6]]}]`,
+		`[{"uuid":"b","Readings":[[0,7,7,7,1,7]]}]`,
+	}
+	if len(written) != len(expected) {
+		t.Fatal("unexpected tuples:", written)
+	}
+	for i := range expected {
+		if written[i] != expected[i] {
+			t.Fatal("expected", expected[i], "but got", written[i])
+		}
+	}
+}
+
+func TestDownsamplePushdown(t *testing.T) {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	err := pipeline.downsample(DownsampleConfig{Bucket: "15min", Aggregates: []string{"max", "count"}, Pushdown: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written := runTestTimeseries(pipeline, makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[0,3,1.5,2,2.5]]}]`)))
+	if len(written) != 1 || written[0] != `[{"uuid":"a","Readings":[[0,2.5,3]]}]` {
+		t.Fatal("unexpected columns:", written)
+	}
+
+	record, err := pipeline.downsampler.metadata(&Metadata{Uuid: "a"})
+	if resolution, _ := record.get(RESOLUTION_FIELD); err != nil || resolution != "15min" {
+		t.Fatal("metadata should note the resolution:", record)
+	}
+}
+
+func TestDownsampleConfig(t *testing.T) {
+	bad := []DownsampleConfig{
+		{Bucket: "7d", Aggregates: []string{"mean"}},
+		{Bucket: "1min"},
+		{Bucket: "1min", Aggregates: []string{"median"}},
+		{Bucket: "1min", Aggregates: []string{"mean", "mean"}},
+		{Bucket: "1min", Aggregates: []string{"last"}, Pushdown: true},
+	}
+	for _, config := range bad {
+		if config.validate() == nil {
+			t.Fatal("expected config to be rejected:", config)
+		}
+	}
+
+	config := DownsampleConfig{Bucket: "15min", Aggregates: []string{"mean"}}
+	if config.validate() != nil || config.queryWidth() != "900s" {
+		t.Fatal("15min buckets should be accepted:", config.validate(), config.queryWidth())
+	}
+}
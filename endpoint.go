@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	API_KEY_HEADER = "X-API-Key"
+)
+
+/* Authentication and TLS settings of the source or destination endpoint.
+ * Secrets can not be set in the config file or by flags. They are read from the
+ * ADM_* environment variables or from the files named by the *_file settings.
+ */
+type EndpointConfig struct {
+	ApiKey string `yaml:"api_key" secret:"true"`
+	ApiKeyFile string `yaml:"api_key_file"`
+	ApiKeyHeader string `yaml:"api_key_header"`
+	BearerToken string `yaml:"bearer_token" secret:"true"`
+	BearerTokenFile string `yaml:"bearer_token_file"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password" secret:"true"`
+	PasswordFile string `yaml:"password_file"`
+	Headers map[string]string `yaml:"headers" redact:"true"` //may carry credentials
+	CaFile string `yaml:"ca_file"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile string `yaml:"key_file"`
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+}
+
+func defaultEndpointConfig() EndpointConfig {
+	return EndpointConfig{
+		ApiKeyHeader: API_KEY_HEADER,
+	}
+}
+
+/* Reads the secrets named by the *_file settings. A secret set directly, e.g. by
+ * an environment variable, takes precedence over its file.
+ */
+func (e *EndpointConfig) loadSecrets() error {
+	secrets := []struct {
+		value *string
+		path string
+	}{
+		{&e.ApiKey, e.ApiKeyFile},
+		{&e.BearerToken, e.BearerTokenFile},
+		{&e.Password, e.PasswordFile},
+	}
+
+	for _, secret := range secrets {
+		if *secret.value != "" || secret.path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(secret.path)
+		if err != nil {
+			return fmt.Errorf("loadSecrets: could not read %s err: %v", secret.path, err)
+		}
+		*secret.value = strings.TrimSpace(string(data))
+	}
+	return nil
+}
+
+func (e *EndpointConfig) validate(name string) error {
+	if e.ApiKey != "" && e.BearerToken != "" {
+		return fmt.Errorf("%s: only one of api_key and bearer_token can be set", name)
+	}
+	if (e.CertFile == "") != (e.KeyFile == "") {
+		return fmt.Errorf("%s: cert_file and key_file must be set together", name)
+	}
+	if e.Password != "" && e.Username == "" {
+		return fmt.Errorf("%s: password requires username", name)
+	}
+	return nil
+}
+
+/* Builds an http.Client that trusts the configured CA bundle and presents the
+ * configured client certificate.
+ */
+func (e *EndpointConfig) httpClient(timeout time.Duration) (*http.Client, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: e.InsecureSkipVerify,
+	}
+
+	if e.CaFile != "" {
+		pem, err := ioutil.ReadFile(e.CaFile)
+		if err != nil {
+			return nil, fmt.Errorf("httpClient: could not read ca_file %s err: %v", e.CaFile, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("httpClient: no certificates found in ca_file %s", e.CaFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if e.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(e.CertFile, e.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("httpClient: could not load client certificate err: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout: timeout,
+		Transport: transport,
+	}, nil
+}
+
+/* Adds the configured headers and credentials to req. */
+func (e *EndpointConfig) authorize(req *http.Request) {
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+
+	if e.ApiKey != "" {
+		header := e.ApiKeyHeader
+		if header == "" {
+			header = API_KEY_HEADER
+		}
+		req.Header.Set(header, e.ApiKey)
+	}
+	if e.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+e.BearerToken)
+	}
+	if e.Username != "" {
+		req.SetBasicAuth(e.Username, e.Password)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	TEST_SECRET = "test_secret.txt"
+	TEST_CA = "test_ca.pem"
+)
+
+func TestEndpointAuthorize(t *testing.T) {
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	ioutil.WriteFile(TEST_SECRET, []byte("s3cret\n"), 0600)
+	defer os.Remove(TEST_SECRET)
+
+	endpoint := defaultEndpointConfig()
+	endpoint.ApiKeyFile = TEST_SECRET
+	endpoint.Username = "adm"
+	endpoint.Password = "hunter2"
+	endpoint.Headers = map[string]string{"X-Tenant": "sdb"}
+	err := endpoint.loadSecrets()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := newQueryClient(defaultRetryPolicy(), endpoint, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.makeQuery(server.URL, "select distinct uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Get(API_KEY_HEADER) != "s3cret" {
+		t.Fatal("api key not read from file:", header.Get(API_KEY_HEADER))
+	}
+	if header.Get("X-Tenant") != "sdb" {
+		t.Fatal("custom header not sent")
+	}
+	if header.Get("Authorization") != "Basic YWRtOmh1bnRlcjI=" {
+		t.Fatal("basic auth not sent:", header.Get("Authorization"))
+	}
+}
+
+func TestEndpointCaFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	defer server.Close()
+
+	untrusted, _ := newQueryClient(defaultRetryPolicy(), defaultEndpointConfig(), nil, nil, nil)
+	untrusted.policy.MaxAttempts = 1
+	_, err := untrusted.makeQuery(server.URL, "select distinct uuid")
+	if err == nil {
+		t.Fatal("self-signed certificate should not be trusted by default")
+	}
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(TEST_CA, ca, 0644)
+	defer os.Remove(TEST_CA)
+
+	endpoint := defaultEndpointConfig()
+	endpoint.CaFile = TEST_CA
+	trusted, err := newQueryClient(defaultRetryPolicy(), endpoint, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = trusted.makeQuery(server.URL, "select distinct uuid")
+	if err != nil {
+		t.Fatal("certificate in ca_file should be trusted:", err)
+	}
+}
+
+func TestConfigRejectsSecretsInFile(t *testing.T) {
+	testConfigStartup("source:\n  bearer_token: abc\n")
+	defer testConfigTeardown()
+
+	_, err := newAdmConfig([]string{"-config", TEST_CONFIG})
+	if err == nil {
+		t.Fatal("secrets in the config file should be rejected")
+	}
+
+	os.Setenv("ADM_SOURCE_BEARER_TOKEN", "abc")
+	defer os.Unsetenv("ADM_SOURCE_BEARER_TOKEN")
+	c, err := newAdmConfig([]string{"-config", "does_not_exist.yml"})
+	if err != nil || c.Source.BearerToken != "abc" {
+		t.Fatal("bearer token should be read from the environment:", err)
+	}
+}
+
+func TestConfigKeepsSecretsOffFlagsAndOutput(t *testing.T) {
+	_, err := newAdmConfig([]string{"-config", "does_not_exist.yml", "-source.bearer_token", "abc"})
+	if err == nil {
+		t.Fatal("secrets should not be accepted as flags")
+	}
+
+	testConfigStartup("source:\n  headers: {X-Auth: t0ken}\n")
+	defer testConfigTeardown()
+	c, err := newAdmConfig([]string{"-config", TEST_CONFIG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Source.Headers["X-Auth"] != "t0ken" {
+		t.Fatal("headers should be read from the config file:", c.Source.Headers)
+	}
+	if printed := c.String(); strings.Contains(printed, "t0ken") {
+		t.Fatal("header value leaked in printed config:", printed)
+	}
+}
+
+func TestManagerReportsBadEndpoint(t *testing.T) {
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+	config := defaultAdmConfig()
+	config.SourceUrl = "https://localhost:8079/api/query"
+	config.MetadataDest = TEST_OUTPUT_DIR + "/metadata.txt"
+	config.TimeseriesDest = TEST_OUTPUT_DIR + "/ts.txt"
+	config.Source.CaFile = "does_not_exist.pem"
+
+	adm, err := newADMManager(config)
+	if adm != nil || err == nil || !strings.Contains(err.Error(), "ca_file") {
+		t.Fatal("an unreadable ca_file should fail the setup:", adm, err)
+	}
+}
+
+func TestNetworkWriterUsesDestinationEndpoint(t *testing.T) {
+	var header http.Header
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header
+	}))
+	defer server.Close()
+
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	ioutil.WriteFile(TEST_CA, ca, 0644)
+	defer os.Remove(TEST_CA)
+
+	os.Setenv("ADM_DESTINATION_BEARER_TOKEN", "t0ken")
+	defer os.Unsetenv("ADM_DESTINATION_BEARER_TOKEN")
+	c, err := newAdmConfig([]string{"-config", "does_not_exist.yml", "-destination.ca_file", TEST_CA})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SourceUrl = "http://localhost:8079/api/query"
+	if err = c.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newNetworkWriter(c.Destination, c.Retry.RequestTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := w.post(server.URL, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal("the destination ca_file should be trusted:", err)
+	}
+	resp.Body.Close()
+	if header.Get("Authorization") != "Bearer t0ken" {
+		t.Fatal("the destination credentials should be sent:", header)
+	}
+
+	c.Destination.CertFile = TEST_CA
+	if err = c.validate(); err == nil || !strings.Contains(err.Error(), "destination") {
+		t.Fatal("the destination endpoint should be validated:", err)
+	}
+}
@@ -5,16 +5,52 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 )
 
 
-type FileWriter struct{}
+type FileWriter struct{
+	compression CompressionConfig
+	chunks *ChunkFiles
+}
 
-func newFileWriter() *FileWriter {
-	return &FileWriter{}
+/* chunks may be nil, in which case timeseries files are not rotated or recorded in a manifest. */
+func newFileWriter(compression CompressionConfig, chunks *ChunkFiles) *FileWriter {
+	return &FileWriter{
+		compression: compression,
+		chunks: chunks,
+	}
+}
+
+/* A file whose writes pass through the configured compression. */
+type outputFile struct {
+	io.WriteCloser
+	file *os.File
+}
+
+func (w *FileWriter) openFile(dest string, flag int) (*outputFile, error) {
+	f, err := os.OpenFile(dest, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := w.compression.newWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &outputFile{WriteCloser: compressed, file: f}, nil
+}
+
+func (f *outputFile) Close() error {
+	err := f.WriteCloser.Close()
+	if err != nil {
+		f.file.Close()
+		return err
+	}
+	return f.file.Close()
 }
 
 func (w *FileWriter) writeUuids(dest string, uuids []string) *ProcessError {
@@ -23,7 +59,13 @@ func (w *FileWriter) writeUuids(dest string, uuids []string) *ProcessError {
 		return newProcessError(fmt.Sprint("writeUuids: could not marshal uuids:", uuids, "err:", err), true, nil)
 	}
 
-	err = ioutil.WriteFile(dest, body, 0644)
+	f, err := w.openFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err == nil {
+		_, err = f.Write(body)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
 	if err != nil {
 		os.Remove(dest)
 		return newProcessError(fmt.Sprint("writeUuids: could not write uuids:", uuids, "err:", err), true, nil)
@@ -33,19 +75,22 @@ func (w *FileWriter) writeUuids(dest string, uuids []string) *ProcessError {
 }
 
 func (w *FileWriter) writeMetadata(dest string, dataChan chan *MetadataTuple) *ProcessError {
-	if !fileExists(dest) {
-		err := ioutil.WriteFile(dest, []byte("["), 0644)
-	    if err != nil {
-	    	return newProcessError(fmt.Sprint("writeMetadata: could not create metadata file:", dest, "err:", err), true, nil)
-	    }
-	}
-
-	f, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0644)
+	created := !fileExists(dest)
+	f, err := w.openFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
 	if err != nil {
 		os.Remove(dest)
 		return newProcessError(fmt.Sprint("writeMetadata: could not open metadata file:", dest, "err:", err), true, nil)
 	}
 
+	if created {
+		_, err = f.Write([]byte("["))
+	    if err != nil {
+	    	f.Close()
+	    	os.Remove(dest)
+	    	return newProcessError(fmt.Sprint("writeMetadata: could not create metadata file:", dest, "err:", err), true, nil)
+	    }
+	}
+
 	first := true
 	wrote := false
 	failed := make([]interface{}, 0)
@@ -90,68 +135,131 @@ func (w *FileWriter) writeMetadata(dest string, dataChan chan *MetadataTuple) *P
 	return nil
 }
 
+/* Writes timeseries data to dest, moving on to the next chunk file whenever the
+ * current one is full and recording each finished file in the manifest.
+ */
 func (w *FileWriter) writeTimeseriesData(dest string, dataChan chan *TimeseriesTuple) *ProcessError {
-	if !fileExists(dest) {
-		err := ioutil.WriteFile(dest, []byte("["), 0644)
-	    if err != nil {
-			return newProcessError(fmt.Sprint("writeTimeseriesData: could not write timeseries data file:", dest, "err:", err), true, nil)
-	    }
-	}
-
-	f, err := os.OpenFile(dest, os.O_APPEND|os.O_WRONLY, 0644)
+	out, err := w.openTimeseriesFile(dest)
 	if err != nil {
-		os.Remove(dest)
+		drainTimeseries(dataChan)
 		return newProcessError(fmt.Sprint("writeTimeseriesData: could not write timeseries data file:", dest, "err:", err), true, nil)
 	}
 
-	first := true
-	wrote := false
 	failed := make([]interface{}, 0)
 	for tuple := range dataChan {
-		log.Println("writeTimeseriesData: write start for uuid", tuple.slot.Uuid, tuple.slot.StartTime, tuple.slot.EndTime, tuple.slot.Count, "to dest", dest)
-		// if !first {
-		// 	_, err := f.Write([]byte(","))
-		// 	if err != nil {
-		// 		os.Remove(dest)
-		// 		return newProcessError(fmt.Sprint("writeTimeseriesData: could not write timeseries data file:", dest, "err:", err), true, nil)
-		// 	}
-		// } else {
-		// 	first = false
-		// }
+		if out.wrote && w.chunks.full(out.bytes, out.chunk.Readings) {
+			current := out.dest
+			err = w.closeTimeseriesFile(out)
+			if err == nil {
+				next := w.chunks.next(tuple.slot.Uuid)
+				log.Println("writeTimeseriesData: rotating", current, "to", next)
+				current = next
+				out, err = w.openTimeseriesFile(next) //nil on error
+			}
+			if err != nil {
+				tuple.done()
+				drainTimeseries(dataChan)
+				return newProcessError(fmt.Sprint("writeTimeseriesData: could not rotate timeseries data file:", current, "err:", err), true, nil)
+			}
+		}
 
+		log.Println("writeTimeseriesData: write start for uuid", tuple.slot.Uuid, tuple.slot.StartTime, tuple.slot.EndTime, tuple.slot.Count, "to dest", out.dest)
 		data := tuple.data
-		if !first {
+		if !out.first {
 			comma := []byte(",")
 			data = append(comma, data...)
 		} else {
-			first = false
+			out.first = false
 		}
 
-		_, err := f.Write(data)
+		_, err := out.Write(data)
+		tuple.done()
 		if err != nil {
-			fmt.Println("writeTimeseriesData: could not write slot:", tuple.slot, tuple.slot.StartTime, tuple.slot.EndTime, "to timeseries data file:", dest, "err:", err)
+			fmt.Println("writeTimeseriesData: could not write slot:", tuple.slot, tuple.slot.StartTime, tuple.slot.EndTime, "to timeseries data file:", out.dest, "err:", err)
 			failed = append(failed, tuple.slot)
+		} else {
+			out.bytes += int64(len(data))
+			out.chunk.addReadings(tuple.slot, tuple.readings)
 		}
-		wrote = true
-		log.Println("writeTimeseriesData: write complete for uuid", tuple.slot.Uuid, tuple.slot.StartTime, tuple.slot.EndTime, "to dest", dest)
+		out.wrote = true
+		log.Println("writeTimeseriesData: write complete for uuid", tuple.slot.Uuid, tuple.slot.StartTime, tuple.slot.EndTime, "to dest", out.dest)
 	}
 
-	if wrote {
-		_, err = f.Write([]byte("]"))
+	err = w.closeTimeseriesFile(out)
+	if err != nil {
+		return newProcessError(fmt.Sprint("writeTimeseriesData: could not close timeseries data file:", out.dest, "err:", err), true, nil)
+	}
+
+	if len(failed) > 0 {
+		return newProcessError(fmt.Sprint("writeTimeseriesData: failed to write uuids:", failed), false, failed)
+	}
+	return nil
+}
+
+/* A chunk file being written by writeTimeseriesData. */
+type timeseriesFile struct {
+	*outputFile
+	dest string
+	first bool
+	wrote bool
+	bytes int64
+	chunk *ManifestChunk
+}
+
+func (w *FileWriter) openTimeseriesFile(dest string) (*timeseriesFile, error) {
+	os.MkdirAll(getDirPath(dest), os.ModePerm)
+	created := !fileExists(dest)
+	f, err := w.openFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+
+	if created {
+		_, err = f.Write([]byte("["))
 		if err != nil {
+			f.Close()
 			os.Remove(dest)
-			return newProcessError(fmt.Sprint("writeTimeseriesData: could not write timeseries data file:", dest, "err:", err), true, nil)
+			return nil, err
 		}
 	}
 
-	err = f.Close()
+	return &timeseriesFile{
+		outputFile: f,
+		dest: dest,
+		first: true,
+		chunk: &ManifestChunk{File: dest, Run: w.chunks.runId(), TimeFormat: w.chunks.timeFormat()},
+	}, nil
+}
+
+func (w *FileWriter) closeTimeseriesFile(out *timeseriesFile) error {
+	if out.wrote {
+		_, err := out.Write([]byte("]"))
+		if err != nil {
+			out.Close()
+			os.Remove(out.dest)
+			return err
+		}
+	}
+
+	err := out.Close()
 	if err != nil {
-		os.Remove(dest)
-		return newProcessError(fmt.Sprint("writeTimeseriesData: could not close timeseries data file:", dest, "err:", err), true, nil)
+		os.Remove(out.dest)
+		return err
 	}
 
-	if len(failed) > 0 {
-		return newProcessError(fmt.Sprint("writeTimeseriesData: failed to write uuids:", failed), false, failed)
+	if w.chunks != nil && out.wrote {
+		err = w.chunks.manifest.add(out.chunk)
+		if err != nil {
+			log.Println("writeTimeseriesData: could not update manifest for", out.dest, "err:", err)
+		}
 	}
 	return nil
 }
+
+/* Releases tuples nobody will write so the reader is not left blocked. */
+func drainTimeseries(dataChan chan *TimeseriesTuple) {
+	for tuple := range dataChan {
+		tuple.done()
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
 )
 
 // To read from files
@@ -27,7 +26,7 @@ func NewFileReader(url string, uuidFile string, metadataFile string, timeseriesF
 }
 
 func (reader *FileReader) ReadAllUuids() {
-	data, err := ioutil.ReadFile(reader.UuidFile)
+	data, err := readDecompressedFile(reader.UuidFile)
 	if err != nil {
 		panic(err)
 	}
@@ -36,7 +35,7 @@ func (reader *FileReader) ReadAllUuids() {
 
 func (reader *FileReader) ReadAllMetadata() {
 	reader.Metadatas = make([][]Metadata, len(reader.Uuids))
-	data, err := ioutil.ReadFile(reader.MetadataFile)
+	data, err := readDecompressedFile(reader.MetadataFile)
 	if err != nil {
 		panic(err)
 	}
@@ -45,7 +44,7 @@ func (reader *FileReader) ReadAllMetadata() {
 
 func (reader *FileReader) ReadAllTimeseriesData() { //work in progress
 	reader.TimeseriesDatas = make([][]TimeseriesData, len(reader.Uuids))
-	data, err := ioutil.ReadFile(reader.MetadataFile)
+	data, err := readDecompressedFile(reader.MetadataFile)
 	if err != nil {
 		panic(err)
 	}
@@ -3,33 +3,80 @@ package main
 import (
     "encoding/json"
     "fmt"
+    "io"
     "log"
-    "strconv"
 )
 
 const (
     WINDOW_BATCH_SIZE = 10
+    WINDOW_WIDTH = "365d"
     METADATA_BATCH_SIZE = 10
-    QUERY_TIMEOUT = 10
-    QUERY_TRIES = 3
 )
 
-type GilesReader struct{}
+/* Tuning of reads from a Giles archiver. Timeseries responses are handed to the
+ * writer in batches of at most batch_readings readings or about batch_bytes bytes.
+ * Slots are fetched page_size readings at a time. Small slots covering the same
+ * time range are read together, up to timeseries_batch_size uuids per query.
+ */
+type GilesConfig struct {
+    BatchReadings int `yaml:"batch_readings"`
+    BatchBytes int `yaml:"batch_bytes"`
+    PageSize int `yaml:"page_size"` //readings per timeseries query. 0 reads each slot in one streamed query.
+    TimeseriesBatchSize int `yaml:"timeseries_batch_size"` //max uuids per timeseries query
+}
+
+type GilesReader struct{
+    client *QueryClient
+    config GilesConfig
+    budget *MemoryBudget
+    statistical string //width of statistical queries when aggregation is pushed down
+}
+
+func defaultGilesConfig() GilesConfig {
+    return GilesConfig {
+        BatchReadings: 10000,
+        BatchBytes: 4 << 20,
+        PageSize: 100000,
+        TimeseriesBatchSize: 10,
+    }
+}
+
+func newGilesReader(client *QueryClient, config GilesConfig, budget *MemoryBudget) *GilesReader {
+    return &GilesReader {
+        client: client,
+        config: config,
+        budget: budget,
+    }
+}
+
+/* Reads timeseries as statistical aggregates over buckets of the configured width. */
+func (r *GilesReader) pushdown(config DownsampleConfig) {
+    r.statistical = config.queryWidth()
+}
 
-func newGilesReader() *GilesReader {
-    return &GilesReader {}
+/* select data, or the statistical aggregates of data when pushed down. */
+func (r *GilesReader) dataQuery() *QueryBuilder {
+    if r.statistical != "" {
+        return newStatisticalQuery(r.statistical)
+    }
+    return newDataQuery()
 }
 
 func (r *GilesReader) readUuids(src string) ([]string, *ProcessError) {
     var uuids []string
-    body, err := makeQuery(src, "select distinct uuid")
+    query, err := newDistinctQuery("uuid").build()
+    if err != nil {
+        return nil, newProcessError(fmt.Sprint("readUuids: could not build query err:", err), true, nil)
+    }
+
+    body, err := r.client.makeQuery(src, query)
     if err != nil {
         return nil, newProcessError(fmt.Sprint("readUuids: read uuids failed err:", err), true, nil)
     }
 
     err = json.Unmarshal(body, &uuids)
     if err != nil {
-        return nil, newProcessError(fmt.Sprint("readUuids: could not unmarshal uuids", uuids, "err:", err), true, nil)
+        return nil, newProcessError(fmt.Sprint("readUuids: could not unmarshal uuids err:", newResponseError(src, query, err)), true, nil)
     }
 
     return uuids, nil
@@ -50,11 +97,11 @@ func (r *GilesReader) readWindows(src string, uuids []string) ([]*Window, *Proce
             if err != nil {
                 log.Println("readWindows: err:", err)
 
-                for _, uuid := range uuids {
+                for _, uuid := range uuidsToBatch {
                     window, err := r.readWindow(src, uuid)
                     if err != nil {
-                        log.Println("readWindowsBatched: bad uuid", uuid)
-                        failed = append(failed, uuid)
+                        log.Println("readWindowsBatched: bad uuid", uuid, "err:", err)
+                        failed = append(failed, newFailedItem(uuid, err))
                     } else {
                         windows = append(windows, window)
                     }
@@ -77,18 +124,20 @@ func (r *GilesReader) readWindows(src string, uuids []string) ([]*Window, *Proce
 
 func (r *GilesReader) readWindowsBatched(src string, uuids []string) ([]*Window, error) {
     var windows []*Window
-    query := "select window(365d) data in (0, now) where uuid ="
+    query, err := newWindowQuery(WINDOW_WIDTH).in(0, -1).as("ns").whereUuids(uuids...).build()
+    if err != nil {
+        return nil, fmt.Errorf("readWindowsBatched: could not build query for uuids: %v err: %v", uuids, err)
+    }
 
-    query = composeBatchQuery(query, uuids)
-    body, err := makeQuery(src, query)
+    body, err := r.client.makeQuery(src, query)
     if err != nil {
         fmt.Println("bad query string:", query)
-        return nil, fmt.Errorf("readWindowsBatched: query failed for uuids:", uuids, "err:", err)
+        return nil, fmt.Errorf("readWindowsBatched: query failed for uuids: %v err: %w", uuids, err)
     }
     err = json.Unmarshal(body, &windows)
 
     if err != nil {
-        return nil, fmt.Errorf("readWindowsBatched: batch window read failed for uuids:", uuids, "query", query, "response:", string(body))
+        return nil, fmt.Errorf("readWindowsBatched: batch window read failed for uuids: %v err: %w", uuids, newResponseError(src, query, err))
     }
 
     return windows, nil
@@ -96,16 +145,20 @@ func (r *GilesReader) readWindowsBatched(src string, uuids []string) ([]*Window,
 
 func (r *GilesReader) readWindow(src string, uuid string) (*Window, error) {
     var window *Window
-    query := "select window(365d) data in (0, now) where uuid = '" + uuid + "'"
-    body, err := makeQuery(src, query)
+    query, err := newWindowQuery(WINDOW_WIDTH).in(0, -1).as("ns").whereUuids(uuid).build()
+    if err != nil {
+        return nil, fmt.Errorf("readWindow: could not build query for uuid: %s err: %v", uuid, err)
+    }
+
+    body, err := r.client.makeQuery(src, query)
     if err != nil {
-        return nil, fmt.Errorf("readWindow: query failed for uuid:", uuid, "err:", err)
+        return nil, fmt.Errorf("readWindow: query failed for uuid: %s err: %w", uuid, err)
     }
 
     var windows [1]*Window
     err = json.Unmarshal(body, &windows)
     if err != nil {
-        return nil, fmt.Errorf("readWindow: could not unmarshal uuid:", uuid, "err:", err)
+        return nil, fmt.Errorf("readWindow: could not unmarshal uuid: %s err: %w", uuid, newResponseError(src, query, err))
     }
 
     window = windows[0]
@@ -124,11 +177,11 @@ func (r *GilesReader) readMetadata(src string, uuids []string, dataChan chan *Me
             
             if err != nil {
                 log.Println("readMetadataBatched: could not unmarshal uuids:", uuidsToBatch, "err:", err)
-                for _, uuid := range uuids {
+                for _, uuid := range uuidsToBatch {
                     singleBody, err := r.readSingleMetadata(src, uuid)
                     if err != nil {
-                        log.Println("readMetadataBatched: bad uuid", uuid)
-                        failed = append(failed, uuid)
+                        log.Println("readMetadataBatched: bad uuid", uuid, "err:", err)
+                        failed = append(failed, newFailedItem(uuid, err))
                     } else {
                         dataChan <- makeMetadataTuple([]string{uuid}, singleBody)
                     }
@@ -150,19 +203,20 @@ func (r *GilesReader) readMetadata(src string, uuids []string, dataChan chan *Me
 
 //helper function
 func (r *GilesReader) readMetadataBatched(src string, uuids []string) ([]byte, error) {
-    query := "select * where uuid ="
+    query, err := newMetadataQuery().whereUuids(uuids...).build()
+    if err != nil {
+        return nil, fmt.Errorf("readMetadataBatched: could not build query for uuids: %v err: %v", uuids, err)
+    }
 
-    query = composeBatchQuery(query, uuids)
-    body, err := makeQuery(src, query)
+    body, err := r.client.makeQuery(src, query)
     if err != nil {
         fmt.Println("bad query string:", query)
-        return nil, fmt.Errorf("readMetadataBatched: query failed for uuids:", uuids, "err:", err)
+        return nil, fmt.Errorf("readMetadataBatched: query failed for uuids: %v err: %w", uuids, err)
     }
 
-    var metadata []*Metadata
-    err = json.Unmarshal(body, &metadata)
+    _, err = parseMetadata(body)
     if err != nil {
-        return nil, fmt.Errorf("readMetadataBatched: could not unmarshal uuids:", uuids, "err:", err)
+        return nil, fmt.Errorf("readMetadataBatched: could not unmarshal uuids: %v err: %w", uuids, newResponseError(src, query, err))
     } else {
         return body, nil
     }
@@ -170,64 +224,296 @@ func (r *GilesReader) readMetadataBatched(src string, uuids []string) ([]byte, e
 
 //helper function
 func (r *GilesReader) readSingleMetadata(src string, uuid string) ([]byte, error) {
-    query := "select * where uuid =" + uuid
-    body, err := makeQuery(src, query)
+    query, err := newMetadataQuery().whereUuids(uuid).build()
     if err != nil {
-        return nil, fmt.Errorf("readSingleMetadata: query failed for uuid:", uuid, "err:", err)
+        return nil, fmt.Errorf("readSingleMetadata: could not build query for uuid: %s err: %v", uuid, err)
     }
 
-    var metadata []*Metadata
-    err = json.Unmarshal(body, &metadata)
+    body, err := r.client.makeQuery(src, query)
     if err != nil {
-        return nil, fmt.Errorf("readSingleMetadata: could not unmarshal uuid:", uuid, "err:", err)
+        return nil, fmt.Errorf("readSingleMetadata: query failed for uuid: %s err: %w", uuid, err)
+    }
+
+    _, err = parseMetadata(body)
+    if err != nil {
+        return nil, fmt.Errorf("readSingleMetadata: could not unmarshal uuid: %s err: %w", uuid, newResponseError(src, query, err))
     }
     return body, nil
 }
 
 func (r *GilesReader) readTimeseriesData(src string, slots []*TimeSlot, dataChan chan *TimeseriesTuple) (*ProcessError) {
     failed := make([]interface{}, 0)
+    for _, group := range r.groupSlots(slots) {
+        if len(group) > 1 {
+            log.Println("readTimeseriesData: making batched query for", len(group), "uuids", group[0].StartTime, group[0].EndTime)
+            err := r.readSlotsBatched(src, group, dataChan)
+            if err == nil {
+                continue
+            }
+            log.Println("readTimeseriesData: batched query failed, reading slots individually err:", err)
+        }
+
+        for _, slot := range group {
+            log.Println("readTimeseriesData: making query for uuid", slot.Uuid, slot.StartTime, slot.EndTime)
+            var err error
+            if r.config.PageSize > 0 {
+                err = r.readSlotPaged(src, slot, dataChan)
+            } else {
+                err = r.readSlotStreamed(src, slot, dataChan)
+            }
+            log.Println("readTimeseriesData: query complete for uuid", slot.Uuid, slot.StartTime, slot.EndTime)
+
+            if err != nil {
+                log.Println("readTimeseriesData: query failed for uuid:", slot.Uuid, "err:", err)
+                failed = append(failed, newFailedItem(slot, err))
+                continue
+            }
+            log.Println("readTimeseriesData: read uuid", slot.Uuid)
+        }
+    }
+    close(dataChan)
+    log.Println("readTimeseriesData: finished read")
+
+    if len(failed) > 0 {
+        return newProcessError(fmt.Sprint("readTimeseriesData: could not read slots:", failed), false, failed)
+    }
+
+    return nil
+}
+
+/* Groups slots covering the same time range so their uuids can share a query.
+ * Only slots small enough to fit in one page together are grouped, at most
+ * timeseries_batch_size per group. Every other slot is returned in a group of its own.
+ */
+func (r *GilesReader) groupSlots(slots []*TimeSlot) [][]*TimeSlot {
+    limit := int64(r.config.PageSize)
+    if limit <= 0 {
+        limit = int64(r.config.BatchReadings)
+    }
+
+    groups := make([][]*TimeSlot, 0)
+    open := make(map[[2]int64]int) //time range -> index of the group still accepting slots
+    counts := make(map[int]int64)
     for _, slot := range slots {
-        startTime := strconv.FormatInt(slot.StartTime, 10) + "ns"
-        endTime := strconv.FormatInt(slot.EndTime, 10) + "ns"
+        key := [2]int64{slot.StartTime, slot.EndTime}
+        i, ok := open[key]
+        if r.config.TimeseriesBatchSize <= 1 || slot.Count > limit {
+            ok = false
+        } else if ok && (len(groups[i]) >= r.config.TimeseriesBatchSize || counts[i] + slot.Count > limit) {
+            ok = false
+        }
 
-        if endTime == "-1ns" {
-            endTime = "now"
+        if !ok {
+            groups = append(groups, []*TimeSlot{slot})
+            i = len(groups) - 1
+            if r.config.TimeseriesBatchSize > 1 && slot.Count <= limit {
+                open[key] = i
+            }
+        } else {
+            groups[i] = append(groups[i], slot)
         }
+        counts[i] += slot.Count
+    }
+    return groups
+}
 
-        log.Println("readTimeseriesData: making query for uuid", slot.Uuid, slot.StartTime, slot.EndTime)
-        query := "select data in (" + startTime + ", " + endTime + ") as ns where uuid='" + slot.Uuid + "'"
-        log.Println("readTimeseriesData: query string:", query)
-        body, err := makeQuery(src, query)
-        log.Println("readTimeseriesData: query complete for uuid", slot.Uuid, slot.StartTime, slot.EndTime)
-        
+/* Reads a group of slots sharing a time range with a single query and splits the
+ * response back into per-slot tuples. The response is buffered so that a failed
+ * batch can be re-read slot by slot without duplicating readings.
+ */
+func (r *GilesReader) readSlotsBatched(src string, slots []*TimeSlot, dataChan chan *TimeseriesTuple) error {
+    uuids := make([]string, len(slots))
+    slotsByUuid := make(map[string]*TimeSlot)
+    for i, slot := range slots {
+        uuids[i] = slot.Uuid
+        slotsByUuid[slot.Uuid] = slot
+    }
+
+    query, err := r.dataQuery().in(slots[0].StartTime, slots[0].EndTime).as("ns").whereUuids(uuids...).build()
+    if err != nil {
+        return fmt.Errorf("readSlotsBatched: could not build query for uuids: %v err: %v", uuids, err)
+    }
+
+    body, err := r.client.makeQuery(src, query)
+    if err != nil {
+        fmt.Println("bad query string:", query)
+        return fmt.Errorf("readSlotsBatched: query failed for uuids: %v err: %w", uuids, err)
+    }
+
+    var timeseries []*TimeseriesData
+    err = json.Unmarshal(body, &timeseries)
+    if err != nil {
+        return fmt.Errorf("readSlotsBatched: could not unmarshal uuids: %v err: %w", uuids, newResponseError(src, query, err))
+    }
+
+    for _, data := range timeseries {
+        slot, ok := slotsByUuid[data.Uuid]
+        if !ok {
+            log.Println("readSlotsBatched: ignoring unrequested uuid", data.Uuid)
+            continue
+        }
+
+        err = r.emitReadings(slot, data.Uuid, data.Readings, dataChan)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+//helper function. reads the whole slot in one streamed query.
+func (r *GilesReader) readSlotStreamed(src string, slot *TimeSlot, dataChan chan *TimeseriesTuple) error {
+    query, err := r.dataQuery().in(slot.StartTime, slot.EndTime).as("ns").whereUuids(slot.Uuid).build()
+    if err != nil {
+        return fmt.Errorf("readSlotStreamed: could not build query for uuid: %s err: %v", slot.Uuid, err)
+    }
+
+    log.Println("readSlotStreamed: query string:", query)
+    err = r.client.streamQuery(src, query, func(body io.Reader) error {
+        return decodeTimeseriesStream(body, slot.Uuid, r.config.BatchReadings, r.config.BatchBytes, func(uuid string, readings [][]json.RawMessage) error {
+            return r.emitTimeseries(slot, uuid, readings, dataChan)
+        })
+    })
+    if err != nil {
+        fmt.Println("bad query string:", query)
+    }
+    return err
+}
+
+/* Reads the slot page_size readings at a time. Each page is decoded as it arrives
+ * like readSlotStreamed, so a page is never held in memory whole. The next page
+ * starts at the last timestamp of the previous one, since the limit may have cut
+ * off readings sharing that timestamp, and the readings already handed on at
+ * that timestamp are dropped from it. The page is made larger by their number so
+ * paging moves on even when more than page_size readings share one timestamp.
+ * A page failing after some of its readings were handed on fails the slot.
+ */
+func (r *GilesReader) readSlotPaged(src string, slot *TimeSlot, dataChan chan *TimeseriesTuple) error {
+    start := slot.StartTime
+    seen := make(map[string]int) //readings handed on at start, by value
+    for page := 0; ; page++ {
+        limit := r.config.PageSize
+        for _, n := range seen {
+            limit += n
+        }
+        query, err := r.dataQuery().in(start, slot.EndTime).limit(limit).as("ns").whereUuids(slot.Uuid).build()
+        if err != nil {
+            return fmt.Errorf("readSlotPaged: could not build query for uuid: %s err: %v", slot.Uuid, err)
+        }
+
+        rows := 0
+        last := start
+        atLast := make(map[string]int)
+        skip := seen
+        err = r.client.streamQuery(src, query, func(body io.Reader) error {
+            return decodeTimeseriesStream(body, slot.Uuid, r.config.BatchReadings, r.config.BatchBytes, func(uuid string, readings [][]json.RawMessage) error {
+                emit := make([][]json.RawMessage, 0, len(readings))
+                for _, reading := range readings {
+                    t, err := readingTime(reading)
+                    if err != nil {
+                        return err
+                    }
+                    rows++
+                    if t != last {
+                        last = t
+                        atLast = make(map[string]int)
+                    }
+                    key := readingValue(reading)
+                    atLast[key]++
+                    if t == start && skip[key] > 0 {
+                        skip[key]--
+                        continue
+                    }
+                    emit = append(emit, reading)
+                }
+                if len(emit) == 0 {
+                    return nil
+                }
+                return r.emitTimeseries(slot, uuid, emit, dataChan)
+            })
+        })
         if err != nil {
             fmt.Println("bad query string:", query)
-            log.Println("readTimeseriesData: query failed for uuid:", slot.Uuid, "err:", err)
-            failed = append(failed, slot)
-            continue
+            return fmt.Errorf("readSlotPaged: page %d of uuid %s failed err: %w", page, slot.Uuid, err)
         }
 
-        var timeseries []*TimeseriesData
-        err = json.Unmarshal(body, &timeseries)
-        fmt.Println("len of channel:", len(dataChan))
+        if rows < limit {
+            return nil
+        }
+        if last < start {
+            log.Println("readSlotPaged: readings of uuid", slot.Uuid, "are not in time order, stopping at page", page)
+            return nil
+        }
+        start, seen = last, atLast
+        log.Println("readSlotPaged: uuid", slot.Uuid, "page", page, "complete. next page starts at", start)
+    }
+}
+
+//helper function. the value fields of a reading, used to tell apart readings sharing a timestamp.
+func readingValue(reading []json.RawMessage) string {
+    value := make([]byte, 0)
+    for _, field := range reading[1:] {
+        value = append(value, field...)
+        value = append(value, ',')
+    }
+    return string(value)
+}
+
+/* Reads at most limit readings of uuid in [start, end) for spot checks. */
+func (r *GilesReader) readSample(src string, uuid string, start int64, end int64, limit int) ([][]json.RawMessage, error) {
+    query, err := newDataQuery().in(start, end).limit(limit).as("ns").whereUuids(uuid).build()
+    if err != nil {
+        return nil, fmt.Errorf("readSample: could not build query for uuid: %s err: %v", uuid, err)
+    }
+
+    body, err := r.client.makeQuery(src, query)
+    if err != nil {
+        return nil, fmt.Errorf("readSample: query failed for uuid: %s err: %w", uuid, err)
+    }
+
+    var timeseries []*TimeseriesData
+    err = json.Unmarshal(body, &timeseries)
+    if err != nil {
+        return nil, fmt.Errorf("readSample: could not unmarshal uuid: %s err: %w", uuid, newResponseError(src, query, err))
+    }
+
+    var readings [][]json.RawMessage
+    for _, data := range timeseries {
+        readings = append(readings, data.Readings...)
+    }
+    return readings, nil
+}
+
+//helper function. hands buffered readings on in batches of batch_readings.
+func (r *GilesReader) emitReadings(slot *TimeSlot, uuid string, readings [][]json.RawMessage, dataChan chan *TimeseriesTuple) error {
+    step := r.config.BatchReadings
+    if step <= 0 {
+        step = len(readings)
+    }
+    for i := 0; i < len(readings); i += step {
+        end := i + step
+        if end > len(readings) {
+            end = len(readings)
+        }
+        err := r.emitTimeseries(slot, uuid, readings[i:end], dataChan)
         if err != nil {
-            log.Println("readTimeseriesData: could not unmarshal slot:", slot.Uuid, "query:", query, "err:", err)
-            fmt.Println("readTimeseriesData: bad data", string(body))
-            failed = append(failed, slot)
-            continue         
-        } else {
-            log.Println("readTimeseriesData: inserting uuid", slot.Uuid, "into channel")
-            dataChan <- makeTimeseriesTuple(slot, body)
-            log.Println("readTimeseriesData: insert complete for uuid", slot.Uuid, "into channel")            
+            return err
         }
-        log.Println("readTimeseriesData: read uuid", slot.Uuid)
     }
-    close(dataChan)
-    log.Println("readTimeseriesData: finished read")
+    return nil
+}
 
-    if len(failed) > 0 {
-        return newProcessError(fmt.Sprint("readTimeseriesData: could not read slots:", failed), false, failed)
+//helper function. blocks until the batch fits in the memory budget.
+func (r *GilesReader) emitTimeseries(slot *TimeSlot, uuid string, readings [][]json.RawMessage, dataChan chan *TimeseriesTuple) error {
+    data, err := json.Marshal([]*TimeseriesData{&TimeseriesData{Uuid: uuid, Readings: readings}})
+    if err != nil {
+        return fmt.Errorf("emitTimeseries: could not marshal readings for uuid: %s err: %v", uuid, err)
     }
 
+    tuple := makeTimeseriesTuple(slot, data)
+    tuple.readings = int64(len(readings))
+    tuple.budget = r.budget
+    tuple.reserved = r.budget.acquire(int64(len(data)))
+    dataChan <- tuple
     return nil
 }
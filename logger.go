@@ -26,6 +26,7 @@ const (
 	WINDOW_BUCKET = "window_data"
 	UUID_METADATA_BUCKET = "uuid_m_status"
 	UUID_TIMESERIES_BUCKET = "uuid_t_status"
+	UUID_MAP_BUCKET = "uuid_map" //source uuid to destination uuid
 
 	/* Metadata bucket keys */
 	/* Status of writes to log */
@@ -84,6 +85,14 @@ func newLoggerWithName(name string) *Logger {
 		return nil
 	})
 
+	db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(UUID_MAP_BUCKET))
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+
 	logger := Logger{
 		log: db,
 	}
@@ -202,6 +211,17 @@ func (logger *Logger) updateUuidTimeseriesStatus(timeSlot *TimeSlot, status LogS
 	return logger.put(UUID_TIMESERIES_BUCKET, convertToByteArray(*timeSlot), buf)
 }
 
+/* UUID Mapping Functions */
+
+/* Returns the destination uuid recorded for uuid, or "" if there is none. */
+func (logger *Logger) getUuidMapping(uuid string) string {
+	return string(logger.get(UUID_MAP_BUCKET, []byte(uuid)))
+}
+
+func (logger *Logger) updateUuidMapping(uuid string, mapped string) error {
+	return logger.put(UUID_MAP_BUCKET, []byte(uuid), []byte(mapped))
+}
+
 /* Lowest level Logger methods. Should not be called directly. */
 func (logger *Logger) get(bucket string, key []byte) []byte {
 	var value []byte
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+)
+
+/* Bounds the bytes of timeseries data held in flight between readers and writers.
+ * Readers acquire the size of each batch before handing it to a writer, and the
+ * writer releases it once the batch is written. A batch larger than the whole
+ * budget waits for everything else to drain and is then let through alone.
+ */
+type MemoryBudget struct {
+	mutex sync.Mutex
+	cond *sync.Cond
+	capacity int64
+	used int64
+}
+
+func newMemoryBudget(capacity int64) *MemoryBudget {
+	b := &MemoryBudget{
+		capacity: capacity,
+	}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+/* Blocks until n bytes fit in the budget and returns the amount reserved, which
+ * must later be passed to release.
+ */
+func (b *MemoryBudget) acquire(n int64) int64 {
+	if b == nil || b.capacity <= 0 {
+		return 0
+	}
+	if n > b.capacity {
+		n = b.capacity
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for b.used + n > b.capacity {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+func (b *MemoryBudget) release(n int64) {
+	if b == nil || n <= 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.used -= n
+	if b.used < 0 {
+		b.used = 0
+	}
+	b.cond.Broadcast()
+}
+
+func (b *MemoryBudget) inUse() int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.used
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryBudgetBlocks(t *testing.T) {
+	b := newMemoryBudget(100)
+	first := b.acquire(80)
+
+	acquired := make(chan int64, 1)
+	go func() {
+		acquired <- b.acquire(50)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire should block beyond the budget")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	b.release(first)
+	second := <-acquired
+	if second != 50 || b.inUse() != 50 {
+		t.Fatal("budget accounting is wrong:", b.inUse())
+	}
+
+	b.release(second)
+	if b.acquire(500) != 100 {
+		t.Fatal("a batch larger than the budget should reserve the whole budget")
+	}
+}
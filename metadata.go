@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+/* ReadingTypes of sMAP streams */
+const (
+	RT_LONG = "long"
+	RT_DOUBLE = "double"
+	RT_STRING = "string"
+)
+
+/* A stream's metadata as returned by the archiver. Keys the model does not know are
+ * kept in Extra and written back unchanged, as are known keys present with zero
+ * values, so decoding and encoding a record loses nothing. Numbers in Metadata,
+ * Actuator and Extra are json.Numbers.
+ */
+type Metadata struct {
+	Path string
+	Uuid string
+	Properties *Properties
+	Metadata map[string]interface{} //tree of objects with string leaves
+	Actuator map[string]interface{}
+	Extra map[string]interface{}
+
+	present map[string]bool
+}
+
+type Properties struct {
+	UnitofMeasure string
+	ReadingType string
+	Timezone string
+	Extra map[string]interface{}
+
+	present map[string]bool
+}
+
+/* Decodes a json object with numbers kept as json.Number. */
+func decodeObject(data []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var object map[string]interface{}
+	err := decoder.Decode(&object)
+	if err != nil {
+		return nil, err
+	}
+	if object == nil {
+		return nil, fmt.Errorf("metadata must be an object")
+	}
+	return object, nil
+}
+
+/* Removes key from object and stores it in *s if it is a string. */
+func takeString(object map[string]interface{}, key string, s *string, present map[string]bool) error {
+	value, ok := object[key]
+	if !ok {
+		return nil
+	}
+	text, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("%s is not a string", key)
+	}
+	*s = text
+	present[key] = true
+	delete(object, key)
+	return nil
+}
+
+/* Removes key from object and stores it in *m if it is an object. */
+func takeObject(object map[string]interface{}, key string, m *map[string]interface{}, present map[string]bool) error {
+	value, ok := object[key]
+	if !ok {
+		return nil
+	}
+	child, ok := value.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%s is not an object", key)
+	}
+	*m = child
+	present[key] = true
+	delete(object, key)
+	return nil
+}
+
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	object, err := decodeObject(data)
+	if err != nil {
+		return err
+	}
+	*m = Metadata{present: make(map[string]bool)}
+	for _, err := range []error{
+		takeString(object, "Path", &m.Path, m.present),
+		takeString(object, "uuid", &m.Uuid, m.present),
+		takeObject(object, "Metadata", &m.Metadata, m.present),
+		takeObject(object, "Actuator", &m.Actuator, m.present),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+
+	var properties map[string]interface{}
+	err = takeObject(object, "Properties", &properties, m.present)
+	if err != nil {
+		return err
+	}
+	if properties != nil {
+		m.Properties, err = newProperties(properties)
+		if err != nil {
+			return fmt.Errorf("Properties: %v", err)
+		}
+	}
+
+	m.Extra = object
+	return nil
+}
+
+func newProperties(object map[string]interface{}) (*Properties, error) {
+	p := &Properties{present: make(map[string]bool)}
+	for _, err := range []error{
+		takeString(object, "UnitofMeasure", &p.UnitofMeasure, p.present),
+		takeString(object, "ReadingType", &p.ReadingType, p.present),
+		takeString(object, "Timezone", &p.Timezone, p.present),
+	} {
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.Extra = object
+	return p, nil
+}
+
+/* Adds key to object if it was decoded or has been given a value. */
+func putField(object map[string]interface{}, key string, value interface{}, present map[string]bool, zero bool) {
+	if present[key] || !zero {
+		object[key] = value
+	}
+}
+
+func (m *Metadata) MarshalJSON() ([]byte, error) {
+	object := make(map[string]interface{})
+	for key, value := range m.Extra {
+		object[key] = value
+	}
+	putField(object, "Path", m.Path, m.present, m.Path == "")
+	putField(object, "uuid", m.Uuid, m.present, m.Uuid == "")
+	putField(object, "Metadata", m.Metadata, m.present, m.Metadata == nil)
+	putField(object, "Actuator", m.Actuator, m.present, m.Actuator == nil)
+	if m.Properties != nil {
+		object["Properties"] = m.Properties
+	}
+	return json.Marshal(object)
+}
+
+func (p *Properties) MarshalJSON() ([]byte, error) {
+	object := make(map[string]interface{})
+	for key, value := range p.Extra {
+		object[key] = value
+	}
+	putField(object, "UnitofMeasure", p.UnitofMeasure, p.present, p.UnitofMeasure == "")
+	putField(object, "ReadingType", p.ReadingType, p.present, p.ReadingType == "")
+	putField(object, "Timezone", p.Timezone, p.present, p.Timezone == "")
+	return json.Marshal(object)
+}
+
+/* Returns a deep copy of the record that later changes to m do not affect. */
+func (m *Metadata) clone() (*Metadata, error) {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	copied := &Metadata{}
+	err = json.Unmarshal(data, copied)
+	if err != nil {
+		return nil, err
+	}
+	return copied, nil
+}
+
+/* Splits a "/" separated path into its first key and the rest. A leading "/" is ignored. */
+func splitMetadataPath(path string) (string, string) {
+	keys := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	if len(keys) == 1 {
+		return keys[0], ""
+	}
+	return keys[0], keys[1]
+}
+
+/* Looks up the field at a "/" separated path, e.g. Properties/UnitofMeasure or
+ * Metadata/Location/Building.
+ */
+func (m *Metadata) get(path string) (interface{}, bool) {
+	key, rest := splitMetadataPath(path)
+	switch {
+	case key == "Path" && rest == "":
+		return m.Path, m.present[key] || m.Path != ""
+	case key == "uuid" && rest == "":
+		return m.Uuid, m.present[key] || m.Uuid != ""
+	case key == "Properties" && rest != "":
+		return m.Properties.get(rest)
+	case key == "Metadata" && rest != "":
+		return getMetadataPath(m.Metadata, rest)
+	case key == "Actuator" && rest != "":
+		return getMetadataPath(m.Actuator, rest)
+	case key == "Metadata" || key == "Actuator" || key == "Properties":
+		return nil, false
+	}
+	return getMetadataPath(m.Extra, path)
+}
+
+/* Sets the field at a "/" separated path, creating objects along the way. */
+func (m *Metadata) set(path string, value interface{}) error {
+	if m.present == nil {
+		m.present = make(map[string]bool)
+	}
+	key, rest := splitMetadataPath(path)
+	switch {
+	case (key == "Path" || key == "uuid") && rest == "":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%s must be a string", key)
+		}
+		if key == "Path" {
+			m.Path = text
+		} else {
+			m.Uuid = text
+		}
+		m.present[key] = true
+		return nil
+	case key == "Properties" && rest != "":
+		if m.Properties == nil {
+			m.Properties = &Properties{}
+		}
+		return m.Properties.set(rest, value)
+	case key == "Metadata" && rest != "":
+		if m.Metadata == nil {
+			m.Metadata = make(map[string]interface{})
+		}
+		return setMetadataPath(m.Metadata, rest, value)
+	case key == "Actuator" && rest != "":
+		if m.Actuator == nil {
+			m.Actuator = make(map[string]interface{})
+		}
+		return setMetadataPath(m.Actuator, rest, value)
+	case key == "Metadata" || key == "Actuator" || key == "Properties":
+		return fmt.Errorf("%s can only be set field by field", key)
+	}
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{})
+	}
+	return setMetadataPath(m.Extra, path, value)
+}
+
+/* Deletes the field at a "/" separated path if it exists. */
+func (m *Metadata) remove(path string) {
+	key, rest := splitMetadataPath(path)
+	switch {
+	case key == "Path" && rest == "":
+		m.Path = ""
+		delete(m.present, key)
+	case key == "uuid" && rest == "":
+		m.Uuid = ""
+		delete(m.present, key)
+	case key == "Properties" && rest == "":
+		m.Properties = nil
+	case key == "Properties":
+		m.Properties.remove(rest)
+	case key == "Metadata" && rest == "":
+		m.Metadata = nil
+		delete(m.present, key)
+	case key == "Metadata":
+		removeMetadataPath(m.Metadata, rest)
+	case key == "Actuator" && rest == "":
+		m.Actuator = nil
+		delete(m.present, key)
+	case key == "Actuator":
+		removeMetadataPath(m.Actuator, rest)
+	default:
+		removeMetadataPath(m.Extra, path)
+	}
+}
+
+func (p *Properties) field(key string) *string {
+	switch key {
+	case "UnitofMeasure":
+		return &p.UnitofMeasure
+	case "ReadingType":
+		return &p.ReadingType
+	case "Timezone":
+		return &p.Timezone
+	}
+	return nil
+}
+
+func (p *Properties) get(path string) (interface{}, bool) {
+	if p == nil {
+		return nil, false
+	}
+	if field := p.field(path); field != nil {
+		return *field, p.present[path] || *field != ""
+	}
+	return getMetadataPath(p.Extra, path)
+}
+
+func (p *Properties) set(path string, value interface{}) error {
+	if p.present == nil {
+		p.present = make(map[string]bool)
+	}
+	if field := p.field(path); field != nil {
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("Properties/%s must be a string", path)
+		}
+		*field = text
+		p.present[path] = true
+		return nil
+	}
+	if p.Extra == nil {
+		p.Extra = make(map[string]interface{})
+	}
+	return setMetadataPath(p.Extra, path, value)
+}
+
+func (p *Properties) remove(path string) {
+	if p == nil {
+		return
+	}
+	if field := p.field(path); field != nil {
+		*field = ""
+		delete(p.present, path)
+		return
+	}
+	removeMetadataPath(p.Extra, path)
+}
+
+/* Returns an error if the record can not be migrated, and describes problems that
+ * do not prevent it from being migrated.
+ */
+func (m *Metadata) validate() ([]string, error) {
+	if !validUuid(m.Uuid) {
+		return nil, fmt.Errorf("bad uuid %q", m.Uuid)
+	}
+
+	var warnings []string
+	if m.Path != "" && !strings.HasPrefix(m.Path, "/") {
+		warnings = append(warnings, fmt.Sprintf("Path %q is not absolute", m.Path))
+	}
+	if m.Properties == nil {
+		return append(warnings, "no Properties"), nil
+	}
+	switch m.Properties.ReadingType {
+	case RT_LONG, RT_DOUBLE, RT_STRING, "":
+	default:
+		warnings = append(warnings, fmt.Sprintf("unknown ReadingType %q", m.Properties.ReadingType))
+	}
+	if m.Properties.Timezone != "" {
+		if _, err := time.LoadLocation(m.Properties.Timezone); err != nil {
+			warnings = append(warnings, fmt.Sprintf("unknown Timezone %q", m.Properties.Timezone))
+		}
+	}
+	return warnings, nil
+}
+
+/* Decodes a json array of metadata records and validates each, logging warnings. */
+func parseMetadata(body []byte) ([]*Metadata, error) {
+	var records []*Metadata
+	err := json.Unmarshal(body, &records)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		if record == nil {
+			return nil, fmt.Errorf("null metadata record")
+		}
+		warnings, err := record.validate()
+		if err != nil {
+			return nil, err
+		}
+		for _, warning := range warnings {
+			log.Println("parseMetadata: uuid", record.Uuid, warning)
+		}
+	}
+	return records, nil
+}
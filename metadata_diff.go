@@ -0,0 +1,326 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+const (
+	METADATA_DIFF_REPORT = "dev/metadata_diff.json"
+	METADATA_CHANGES = "dev/metadata_changes.json"
+)
+
+type ValueChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+/* Differences between the stored and current metadata of a uuid. Keys are "/"
+ * separated paths to the leaves of the record and values are json.
+ */
+type MetadataChange struct {
+	Uuid string `json:"uuid"`
+	Added map[string]string `json:"added,omitempty"`
+	Removed map[string]string `json:"removed,omitempty"`
+	Changed map[string]*ValueChange `json:"changed,omitempty"`
+}
+
+type MetadataDiffReport struct {
+	Snapshot string `json:"snapshot"`
+	Uuids int `json:"uuids"`
+	Unchanged int `json:"unchanged"`
+	New []string `json:"new"` //uuids not in the snapshot
+	Gone []string `json:"gone"` //uuids in the snapshot the source no longer returns
+	Changed []*MetadataChange `json:"changed"`
+	Pushed int `json:"pushed"`
+	PushDest string `json:"push_dest,omitempty"`
+}
+
+type MetadataDiffOptions struct {
+	snapshot string //metadata previously written. the metadata destination by default.
+	save string //where to store the current metadata as the next snapshot
+	push bool
+	changes string //destination of pushed metadata in file write mode
+}
+
+/* Flattens a record into its leaves keyed by "/" separated path, as json. Empty
+ * objects are leaves.
+ */
+func flattenMetadata(record *Metadata) (map[string]string, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	object, err := decodeObject(body)
+	if err != nil {
+		return nil, err
+	}
+	leaves := make(map[string]string)
+	err = flattenObject(object, "", leaves)
+	if err != nil {
+		return nil, err
+	}
+	return leaves, nil
+}
+
+func flattenObject(object map[string]interface{}, prefix string, leaves map[string]string) error {
+	for key, value := range object {
+		path := prefix + key
+		if child, ok := value.(map[string]interface{}); ok && len(child) > 0 {
+			err := flattenObject(child, path + "/", leaves)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		body, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		leaves[path] = string(body)
+	}
+	return nil
+}
+
+/* Returns the differences between two records of a uuid, or nil if there are none. */
+func diffMetadata(old *Metadata, current *Metadata) (*MetadataChange, error) {
+	before, err := flattenMetadata(old)
+	if err != nil {
+		return nil, err
+	}
+	after, err := flattenMetadata(current)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &MetadataChange{
+		Uuid: current.Uuid,
+		Added: make(map[string]string),
+		Removed: make(map[string]string),
+		Changed: make(map[string]*ValueChange),
+	}
+	for path, value := range after {
+		previous, ok := before[path]
+		if !ok {
+			change.Added[path] = value
+		} else if previous != value {
+			change.Changed[path] = &ValueChange{Old: previous, New: value}
+		}
+	}
+	for path, value := range before {
+		if _, ok := after[path]; !ok {
+			change.Removed[path] = value
+		}
+	}
+
+	if len(change.Added) == 0 && len(change.Removed) == 0 && len(change.Changed) == 0 {
+		return nil, nil
+	}
+	return change, nil
+}
+
+/* Reads a snapshot in the format written by the FileWriter or saveMetadataSnapshot. */
+func loadMetadataSnapshot(path string) (map[string]*Metadata, error) {
+	index := newMetadataIndex()
+	err := index.load(path)
+	if err != nil {
+		return nil, err
+	}
+	return index.records, nil
+}
+
+func saveMetadataSnapshot(path string, records []*Metadata) error {
+	body, err := json.Marshal([][]*Metadata{records})
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(path), os.ModePerm)
+	return writeFileAtomic(path, body)
+}
+
+/* Reads the metadata of every uuid from the source and passes it through the
+ * pipeline, so records compare against what a migration would write.
+ */
+func (adm *ADMManager) readCurrentMetadata() ([]*Metadata, error) {
+	dataChan := make(chan *MetadataTuple, CHANNEL_BUFFER_SIZE)
+	transformedChan, transformed := adm.transformMetadata(dataChan)
+	readDone := make(chan *ProcessError, 1)
+	go func() {
+		readDone <- adm.reader.readMetadata(adm.url, adm.uuids, dataChan)
+	}()
+
+	var records []*Metadata
+	var parseErr error
+	for tuple := range transformedChan {
+		var batch []*Metadata
+		err := json.Unmarshal(tuple.data, &batch)
+		if err != nil && parseErr == nil {
+			parseErr = fmt.Errorf("could not parse metadata of uuids: %v err: %v", tuple.uuids, err)
+		}
+		records = append(records, batch...)
+	}
+	if parseErr != nil {
+		return nil, parseErr
+	}
+
+	for _, err := range []*ProcessError{<-readDone, <-transformed} {
+		if err == nil {
+			continue
+		}
+		if err.Fatal() {
+			return nil, err
+		}
+		log.Println("metadata-diff: some uuids were skipped err:", err)
+	}
+	return records, nil
+}
+
+/* Writes the records through the writer. In file write mode they go to their own
+ * file rather than being appended to the migrated metadata.
+ */
+func (adm *ADMManager) pushMetadata(records []*Metadata, changes string) (string, *ProcessError) {
+	dest := adm.getMetadataDest()()
+	if adm.writeMode == WM_FILE {
+		dest = changes + adm.config.Compression.extension()
+		os.MkdirAll(getDirPath(dest), os.ModePerm)
+		os.Remove(dest)
+	}
+
+	dataChan := make(chan *MetadataTuple, len(records))
+	for _, record := range records {
+		data, err := json.Marshal([]*Metadata{record})
+		if err != nil {
+			close(dataChan)
+			return dest, newProcessError(fmt.Sprint("pushMetadata: could not marshal uuid:", record.Uuid, "err:", err), true, nil)
+		}
+		dataChan <- makeMetadataTuple([]string{record.Uuid}, data)
+	}
+	close(dataChan)
+	return dest, adm.writer.writeMetadata(dest, dataChan)
+}
+
+/* Compares the current metadata of the uuids against a snapshot of the metadata
+ * previously written, and optionally pushes the new and changed records.
+ */
+func (adm *ADMManager) metadataDiff(options MetadataDiffOptions) (*MetadataDiffReport, error) {
+	snapshot := options.snapshot
+	if snapshot == "" {
+		if adm.writeMode != WM_FILE {
+			return nil, fmt.Errorf("metadata-diff: -snapshot is required unless metadata is written in file write mode")
+		}
+		snapshot = adm.getMetadataDest()()
+	}
+	stored, err := loadMetadataSnapshot(snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("metadata-diff: could not load snapshot %s err: %v", snapshot, err)
+	}
+
+	records, err := adm.readCurrentMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MetadataDiffReport{Snapshot: snapshot, Uuids: len(records)}
+	var push []*Metadata
+	seen := make(map[string]bool)
+	for _, record := range records {
+		seen[record.Uuid] = true
+		old, ok := stored[record.Uuid]
+		if !ok {
+			report.New = append(report.New, record.Uuid)
+			push = append(push, record)
+			continue
+		}
+		change, err := diffMetadata(old, record)
+		if err != nil {
+			return nil, fmt.Errorf("metadata-diff: could not compare uuid %s err: %v", record.Uuid, err)
+		}
+		if change == nil {
+			report.Unchanged++
+			continue
+		}
+		report.Changed = append(report.Changed, change)
+		push = append(push, record)
+	}
+	for uuid := range stored {
+		if !seen[uuid] {
+			report.Gone = append(report.Gone, uuid)
+		}
+	}
+	sort.Strings(report.New)
+	sort.Strings(report.Gone)
+	sort.Slice(report.Changed, func(i, j int) bool { return report.Changed[i].Uuid < report.Changed[j].Uuid })
+
+	if options.push && len(push) > 0 {
+		dest, pushErr := adm.pushMetadata(push, options.changes)
+		report.PushDest = dest
+		if pushErr != nil && pushErr.Fatal() {
+			return nil, pushErr
+		}
+		report.Pushed = len(push)
+		if pushErr != nil {
+			log.Println("metadata-diff: some records could not be pushed err:", pushErr)
+			report.Pushed -= len(pushErr.Failed())
+		}
+	}
+
+	if options.save != "" {
+		err = saveMetadataSnapshot(options.save, records)
+		if err != nil {
+			return nil, fmt.Errorf("metadata-diff: could not save snapshot %s err: %v", options.save, err)
+		}
+	}
+	return report, nil
+}
+
+/* Entry point of `adm metadata-diff`. */
+func runMetadataDiff(args []string) error {
+	fs := flag.NewFlagSet("metadata-diff", flag.ContinueOnError)
+	options := MetadataDiffOptions{}
+	fs.StringVar(&options.snapshot, "snapshot", "", "metadata to compare against. defaults to the metadata destination in file write mode")
+	fs.StringVar(&options.save, "save", "", "where to store the current metadata as a snapshot for the next comparison")
+	fs.BoolVar(&options.push, "push", false, "write the new and changed metadata through the writer")
+	fs.StringVar(&options.changes, "changes", METADATA_CHANGES, "file pushed metadata is written to in file write mode")
+	reportPath := fs.String("report", METADATA_DIFF_REPORT, "where to write the json report")
+	config, err := newAdmConfigWithFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	err = config.validate()
+	if err != nil {
+		return err
+	}
+
+	adm, err := newADMManager(config)
+	if err != nil {
+		return err
+	}
+
+	adm.processUuids()
+	report, err := adm.metadataDiff(options)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(*reportPath), os.ModePerm)
+	err = writeFileAtomic(*reportPath, body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("metadata-diff:", report.Unchanged, "of", report.Uuids, "uuids unchanged,", len(report.Changed), "changed,",
+		len(report.New), "new,", len(report.Gone), "gone from the source,", report.Pushed, "pushed")
+	for _, change := range report.Changed {
+		fmt.Println(" ", change.Uuid, "added:", len(change.Added), "removed:", len(change.Removed), "changed:", len(change.Changed))
+	}
+	fmt.Println("metadata-diff: report written to", *reportPath)
+	return nil
+}
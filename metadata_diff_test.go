@@ -0,0 +1,73 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+const (
+	TEST_SNAPSHOT_FILE = "test_metadata_snapshot.json"
+	TEST_CHANGES_FILE = "test_metadata_changes.json"
+)
+
+func TestMetadataDiffKeys(t *testing.T) {
+	old := &Metadata{Uuid: "a"}
+	old.set("Properties/UnitofMeasure", "F")
+	old.set("Metadata/Location/Building", "Soda")
+	old.set("Metadata/Point/Type", "Sensor")
+	current := &Metadata{Uuid: "a"}
+	current.set("Properties/UnitofMeasure", "C")
+	current.set("Metadata/Location/Building", "Soda")
+	current.set("Metadata/Location/Floor", "4")
+
+	change, err := diffMetadata(old, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change == nil || change.Added["Metadata/Location/Floor"] != `"4"` || change.Removed["Metadata/Point/Type"] != `"Sensor"` ||
+		change.Changed["Properties/UnitofMeasure"].Old != `"F"` || len(change.Added)+len(change.Removed)+len(change.Changed) != 3 {
+		t.Fatal("unexpected change:", change)
+	}
+
+	if change, _ := diffMetadata(current, current); change != nil {
+		t.Fatal("a record should not differ from itself:", change)
+	}
+}
+
+func TestMetadataDiffPushesChanges(t *testing.T) {
+	defer os.Remove(TEST_SNAPSHOT_FILE)
+	defer os.Remove(TEST_CHANGES_FILE)
+	uuid := "0f2c5a1e-9a7b-4c3d-8e6f-112233445566"
+	gone := "0f2c5a1e-9a7b-4c3d-8e6f-112233445567"
+	server, _ := newTestServer([]int{200}, `[{"uuid":"`+uuid+`","Properties":{"UnitofMeasure":"C"}}]`)
+	defer server.Close()
+
+	old := &Metadata{Uuid: uuid}
+	old.set("Properties/UnitofMeasure", "F")
+	err := saveMetadataSnapshot(TEST_SNAPSHOT_FILE, []*Metadata{old, &Metadata{Uuid: gone}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adm := &ADMManager{
+		url: server.URL,
+		uuids: []string{uuid},
+		writeMode: WM_FILE,
+		reader: newGilesReader(newTestQueryClient(), defaultGilesConfig(), nil),
+		writer: newFileWriter(CompressionConfig{}, nil),
+		config: &AdmConfig{},
+	}
+	report, err := adm.metadataDiff(MetadataDiffOptions{snapshot: TEST_SNAPSHOT_FILE, push: true, changes: TEST_CHANGES_FILE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Changed) != 1 || report.Changed[0].Changed["Properties/UnitofMeasure"].New != `"C"` ||
+		len(report.Gone) != 1 || report.Gone[0] != gone || report.Pushed != 1 {
+		t.Fatal("unexpected report:", report)
+	}
+
+	pushed, err := loadMetadataSnapshot(TEST_CHANGES_FILE)
+	if err != nil || pushed[uuid] == nil || pushed[uuid].Properties.UnitofMeasure != "C" {
+		t.Fatal("the changed record should have been pushed:", pushed, err)
+	}
+}
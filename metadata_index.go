@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+/* Metadata records of the migrated uuids as read from the source, for transforms
+ * that act on timeseries according to the stream's metadata. Safe for concurrent use.
+ */
+type MetadataIndex struct {
+	mutex sync.RWMutex
+	records map[string]*Metadata
+	required bool
+}
+
+func newMetadataIndex() *MetadataIndex {
+	return &MetadataIndex{
+		records: make(map[string]*Metadata),
+	}
+}
+
+/* Marks the index as needed, so metadata is migrated before timeseries data. */
+func (m *MetadataIndex) require() {
+	m.required = true
+}
+
+func (m *MetadataIndex) needed() bool {
+	return m != nil && m.required
+}
+
+func (m *MetadataIndex) observe(record *Metadata) {
+	if record.Uuid != "" {
+		m.put(record.Uuid, record)
+	}
+}
+
+func (m *MetadataIndex) put(uuid string, record *Metadata) {
+	m.mutex.Lock()
+	m.records[uuid] = record
+	m.mutex.Unlock()
+}
+
+func (m *MetadataIndex) lookup(uuid string) (*Metadata, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	record, ok := m.records[uuid]
+	return record, ok
+}
+
+func (m *MetadataIndex) size() int {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.records)
+}
+
+/* Fills the index from a metadata file written by the FileWriter, for runs that
+ * resume after the metadata was migrated.
+ */
+func (m *MetadataIndex) load(path string) error {
+	f, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for decoder.More() {
+			var batch []*Metadata
+			err = decoder.Decode(&batch)
+			if err != nil {
+				return err
+			}
+			for _, record := range batch {
+				m.observe(record)
+			}
+		}
+
+		_, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+}
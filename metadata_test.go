@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const TEST_METADATA = `{"Actuator":{"Model":"binary","States":[0,1]},"Metadata":{"Location":{"Building":"Soda"},"Point":{}},"Path":"/soda/temp","Properties":{"ReadingType":"double","Resolution":0.10,"Timezone":"America/Los_Angeles","UnitofMeasure":""},"uuid":"6b3a2d34-1c3f-4a3c-8b6e-7d2f1c6a9e01","x":{"y":12345678901234567890}}`
+
+func TestMetadataRoundTrip(t *testing.T) {
+	var record Metadata
+	err := json.Unmarshal([]byte(TEST_METADATA), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Path != "/soda/temp" || record.Properties.ReadingType != RT_DOUBLE || record.Properties.Timezone != "America/Los_Angeles" {
+		t.Fatal("known fields not decoded:", record)
+	}
+	if building, _ := record.get("Metadata/Location/Building"); building != "Soda" {
+		t.Fatal("unexpected building:", building)
+	}
+
+	body, err := json.Marshal(&record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != TEST_METADATA {
+		t.Fatal("round trip lost data:", string(body))
+	}
+}
+
+func TestMetadataPaths(t *testing.T) {
+	record := &Metadata{Uuid: "a"}
+	for path, value := range map[string]string{
+		"Properties/UnitofMeasure": "C",
+		"Properties/SourceUnitofMeasure": "F",
+		"Metadata/Location/Building": "Soda",
+		"Tag": "x",
+	} {
+		if err := record.set(path, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if record.Properties.UnitofMeasure != "C" {
+		t.Fatal("UnitofMeasure should be typed:", record.Properties)
+	}
+	if err := record.set("Metadata", "x"); err == nil {
+		t.Fatal("setting a whole tree should fail")
+	}
+
+	record.remove("Properties/SourceUnitofMeasure")
+	record.remove("Tag")
+	body, _ := json.Marshal(record)
+	if string(body) != `{"Metadata":{"Location":{"Building":"Soda"}},"Properties":{"UnitofMeasure":"C"},"uuid":"a"}` {
+		t.Fatal("unexpected record:", string(body))
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	records, err := parseMetadata([]byte(`[` + TEST_METADATA + `,{"uuid":"6b3a2d34-1c3f-4a3c-8b6e-7d2f1c6a9e02","Properties":{"ReadingType":"decimal","Timezone":"Mars/Olympus"}}]`))
+	if err != nil || len(records) != 2 {
+		t.Fatal("records should parse:", records, err)
+	}
+	warnings, _ := records[1].validate()
+	if len(warnings) != 2 {
+		t.Fatal("expected ReadingType and Timezone warnings:", warnings)
+	}
+
+	bad := []string{
+		`[{"uuid":"a"}]`,
+		`[{"Path":"/a"}]`,
+		`[{"uuid":"6b3a2d34-1c3f-4a3c-8b6e-7d2f1c6a9e01","Properties":[]}]`,
+		`[null]`,
+		`{}`,
+	}
+	for _, body := range bad {
+		if _, err := parseMetadata([]byte(body)); err == nil {
+			t.Fatal("metadata should be rejected:", body)
+		}
+	}
+}
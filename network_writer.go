@@ -1,11 +1,37 @@
 package main
 
-type NetworkWriter struct {
+import (
+	"io"
+	"net/http"
+	"time"
+)
 
+/* Writes to a destination archiver over http, authenticated and with the TLS
+ * settings of the destination endpoint.
+ */
+type NetworkWriter struct {
+	endpoint EndpointConfig
+	client *http.Client
 }
 
-func newNetworkWriter() *NetworkWriter {
+func newNetworkWriter(endpoint EndpointConfig, timeout time.Duration) (*NetworkWriter, error) {
+	client, err := endpoint.httpClient(timeout)
+	if err != nil {
+		return nil, err
+	}
 	return &NetworkWriter {
+		endpoint: endpoint,
+		client: client,
+	}, nil
+}
 
+/* Sends body to url with the destination's headers and credentials. */
+func (w *NetworkWriter) post(url string, contentType string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
 	}
+	req.Header.Set("Content-Type", contentType)
+	w.endpoint.authorize(req)
+	return w.client.Do(req)
 }
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_JOB = "adm"
+	MANIFEST_FILE = "manifest.json"
+	UUID_PREFIX_LENGTH = 8
+)
+
+var templateField = regexp.MustCompile(`\{(\w+)(?::([^}]+))?\}`)
+
+/* Naming and rotation of timeseries chunk files in file write mode.
+ * Template placeholders are {dir}, {name} and {ext} of timeseries_dest, {job},
+ * {chunk} and {uuid_prefix} of the first uuid written to the file. A placeholder
+ * may carry a printf format, e.g. {chunk:05d}. The compression suffix is appended
+ * to the expanded name.
+ */
+type OutputConfig struct {
+	Template string `yaml:"template"`
+	Job string `yaml:"job"`
+	RotateBytes int64 `yaml:"rotate_bytes"`
+	RotateReadings int64 `yaml:"rotate_readings"`
+	Manifest string `yaml:"manifest"`
+	TimeFormat string `yaml:"time_format"` //ns, us, ms, s or rfc3339
+	Timezone string `yaml:"timezone"` //of rfc3339 timestamps of streams without Properties/Timezone. Empty is UTC.
+}
+
+func defaultOutputConfig() OutputConfig {
+	return OutputConfig{
+		Job: DEFAULT_JOB,
+		TimeFormat: TF_NS,
+	}
+}
+
+/* Whether timestamps are written as read, in nanoseconds. */
+func (c *OutputConfig) exactTimes() bool {
+	return c.TimeFormat == "" || c.TimeFormat == TF_NS
+}
+
+func (c *OutputConfig) validate() error {
+	if c.RotateBytes < 0 || c.RotateReadings < 0 {
+		return fmt.Errorf("output.rotate_bytes and output.rotate_readings can not be negative")
+	}
+	if c.Template != "" && !strings.Contains(c.Template, "{chunk") {
+		return fmt.Errorf("output.template must contain {chunk} so chunk files get distinct names")
+	}
+	if !c.exactTimes() && !validTimeFormat(c.TimeFormat) {
+		return fmt.Errorf("output.time_format must be one of ns, us, ms, s and rfc3339")
+	}
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		return fmt.Errorf("output.timezone: %v", err)
+	}
+	for _, match := range templateField.FindAllStringSubmatch(c.Template, -1) {
+		switch match[1] {
+		case "dir", "name", "ext", "job", "chunk", "uuid_prefix":
+		default:
+			return fmt.Errorf("output.template: unknown placeholder {%s}", match[1])
+		}
+	}
+	return nil
+}
+
+/* Hands out chunk file names and records finished chunks in the manifest.
+ * Safe for concurrent use by several writers.
+ */
+type ChunkFiles struct {
+	config OutputConfig
+	dest string
+	extension string
+	manifest *Manifest
+	run string
+
+	mutex sync.Mutex
+	count int
+}
+
+func newChunkFiles(config OutputConfig, dest string, compression CompressionConfig) (*ChunkFiles, error) {
+	manifestPath := config.Manifest
+	if manifestPath == "" {
+		manifestPath = filepath.Join(filepath.Dir(dest), MANIFEST_FILE)
+	}
+	manifest, err := loadManifest(manifestPath, config.Job)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChunkFiles{
+		config: config,
+		dest: dest,
+		extension: compression.extension(),
+		manifest: manifest,
+		run: newRunId(),
+		count: len(manifest.Chunks),
+	}, nil
+}
+
+/* Returns the name of the next chunk file. uuid is the first uuid to be written to it.
+ * Numbering continues after the files already in the manifest and skips existing
+ * files, so a resumed run never appends to the output of an earlier one.
+ */
+func (c *ChunkFiles) next(uuid string) string {
+	for {
+		name := c.name(uuid)
+		if !fileExists(name) {
+			return name
+		}
+	}
+}
+
+func (c *ChunkFiles) name(uuid string) string {
+	c.mutex.Lock()
+	chunk := c.count
+	c.count++
+	c.mutex.Unlock()
+
+	ext := strings.TrimPrefix(filepath.Ext(c.dest), ".")
+	template := c.config.Template
+	if template == "" {
+		template = "{dir}/{name}{chunk}"
+		if ext != "" {
+			template += ".{ext}"
+		}
+	}
+
+	prefix := uuid
+	if len(prefix) > UUID_PREFIX_LENGTH {
+		prefix = prefix[:UUID_PREFIX_LENGTH]
+	}
+	values := map[string]interface{}{
+		"dir": filepath.Dir(c.dest),
+		"name": strings.TrimSuffix(filepath.Base(c.dest), filepath.Ext(c.dest)),
+		"ext": ext,
+		"job": c.config.Job,
+		"chunk": chunk,
+		"uuid_prefix": prefix,
+	}
+	return expandTemplate(template, values) + c.extension
+}
+
+/* Identifies the run writing the chunk files. */
+func (c *ChunkFiles) runId() string {
+	if c == nil {
+		return ""
+	}
+	return c.run
+}
+
+/* Records that every reading of slots read by this run was written. */
+func (c *ChunkFiles) markComplete(slots []*TimeSlot) error {
+	if c == nil || len(slots) == 0 {
+		return nil
+	}
+	return c.manifest.markComplete(c.run, slots)
+}
+
+/* Format of the timestamps written to the chunk files. Empty is ns. */
+func (c *ChunkFiles) timeFormat() string {
+	if c == nil || c.config.exactTimes() {
+		return ""
+	}
+	return c.config.TimeFormat
+}
+
+/* Reports whether a file holding bytes bytes and readings readings is full. */
+func (c *ChunkFiles) full(bytes int64, readings int64) bool {
+	if c == nil {
+		return false
+	}
+	return (c.config.RotateBytes > 0 && bytes >= c.config.RotateBytes) ||
+		(c.config.RotateReadings > 0 && readings >= c.config.RotateReadings)
+}
+
+func expandTemplate(template string, values map[string]interface{}) string {
+	return templateField.ReplaceAllStringFunc(template, func(field string) string {
+		match := templateField.FindStringSubmatch(field)
+		value, ok := values[match[1]]
+		if !ok {
+			return field
+		}
+		if match[2] != "" {
+			return fmt.Sprintf("%"+match[2], value)
+		}
+		return fmt.Sprint(value)
+	})
+}
+
+/* Lists every chunk file written by the job. */
+type Manifest struct {
+	Job string `json:"job"`
+	Chunks []*ManifestChunk `json:"chunks"`
+
+	path string
+	mutex sync.Mutex
+}
+
+type ManifestChunk struct {
+	File string `json:"file"`
+	Run string `json:"run,omitempty"` //when the run that wrote the file started
+	TimeFormat string `json:"time_format,omitempty"` //of the readings' timestamps. empty is ns.
+	Bytes int64 `json:"bytes"`
+	Sha256 string `json:"sha256"`
+	Readings int64 `json:"readings"`
+	Slots []*ManifestSlot `json:"slots"`
+}
+
+type ManifestSlot struct {
+	Uuid string `json:"uuid"`
+	StartTime int64 `json:"start_time"`
+	EndTime int64 `json:"end_time"`
+	Readings int64 `json:"readings"`
+	Complete bool `json:"complete,omitempty"` //every reading of the slot read by the run was written
+}
+
+/* Reads the manifest at path, or starts an empty one if there is none yet. */
+func loadManifest(path string, job string) (*Manifest, error) {
+	manifest := &Manifest{
+		Job: job,
+		path: path,
+	}
+	if !fileExists(path) {
+		return manifest, nil
+	}
+
+	body, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadManifest: could not read %s err: %v", path, err)
+	}
+	err = json.Unmarshal(body, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("loadManifest: could not parse %s err: %v", path, err)
+	}
+	return manifest, nil
+}
+
+/* Records a finished chunk file with its size and checksum and saves the manifest.
+ * A file written to again, e.g. by a resumed run, has its entry extended.
+ */
+func (m *Manifest) add(chunk *ManifestChunk) error {
+	size, sum, err := fileDigest(chunk.File)
+	if err != nil {
+		return fmt.Errorf("add: could not checksum %s err: %v", chunk.File, err)
+	}
+	chunk.Bytes = size
+	chunk.Sha256 = sum
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	found := false
+	for _, existing := range m.Chunks {
+		if existing.File == chunk.File {
+			existing.Bytes = chunk.Bytes
+			existing.Sha256 = chunk.Sha256
+			existing.Readings += chunk.Readings
+			existing.Slots = append(existing.Slots, chunk.Slots...)
+			found = true
+			break
+		}
+	}
+	if !found {
+		m.Chunks = append(m.Chunks, chunk)
+	}
+	return m.save()
+}
+
+/* Marks the slots written by run as complete and saves the manifest. */
+func (m *Manifest) markComplete(run string, slots []*TimeSlot) error {
+	complete := make(map[slotKey]bool)
+	for _, slot := range slots {
+		complete[slotKey{slot.Uuid, slot.StartTime, slot.EndTime}] = true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	changed := false
+	for _, chunk := range m.Chunks {
+		if chunk.Run != run {
+			continue
+		}
+		for _, slot := range chunk.Slots {
+			if !slot.Complete && complete[slotKey{slot.Uuid, slot.StartTime, slot.EndTime}] {
+				slot.Complete = true
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return m.save()
+}
+
+/* Replaces the manifest file in one rename so readers never see a partial manifest. */
+func (m *Manifest) save() error {
+	body, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("save: could not marshal manifest err: %v", err)
+	}
+
+	return writeFileAtomic(m.path, body)
+}
+
+/* Writes body to path.tmp and renames it over path. */
+func writeFileAtomic(path string, body []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("writeFileAtomic: could not write %s err: %v", tmp, err)
+	}
+	_, err = f.Write(body)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writeFileAtomic: could not write %s err: %v", tmp, err)
+	}
+	return os.Rename(tmp, path)
+}
+
+/* Returns the size and hex SHA-256 of the file at path as stored on disk. */
+func fileDigest(path string) (int64, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+/* Adds readings of slot to the chunk, merging consecutive batches of the same slot. */
+func (c *ManifestChunk) addReadings(slot *TimeSlot, readings int64) {
+	c.Readings += readings
+	if n := len(c.Slots); n > 0 {
+		last := c.Slots[n-1]
+		if last.Uuid == slot.Uuid && last.StartTime == slot.StartTime && last.EndTime == slot.EndTime {
+			last.Readings += readings
+			return
+		}
+	}
+	c.Slots = append(c.Slots, &ManifestSlot{
+		Uuid: slot.Uuid,
+		StartTime: slot.StartTime,
+		EndTime: slot.EndTime,
+		Readings: readings,
+	})
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	TEST_OUTPUT_DIR = "test_output"
+)
+
+func TestChunkFilesDefaultNames(t *testing.T) {
+	cases := map[string]string{
+		"data/timeseries/ts.txt": "data/timeseries/ts0.txt",
+		"data/time.series/ts.v1.json": "data/time.series/ts.v10.json",
+		"data/timeseries/ts": "data/timeseries/ts0",
+	}
+	for dest, expected := range cases {
+		chunks := &ChunkFiles{config: defaultOutputConfig(), dest: dest}
+		if name := chunks.next("abc"); name != expected {
+			t.Fatal("expected", expected, "for", dest, "but got", name)
+		}
+	}
+}
+
+func TestChunkFilesTemplate(t *testing.T) {
+	config := defaultOutputConfig()
+	config.Template = "{dir}/{job}/ts-{chunk:05d}-{uuid_prefix}.{ext}"
+	config.Job = "soda"
+	chunks := &ChunkFiles{config: config, dest: "data/ts.json", extension: ".gz"}
+
+	chunks.next("0123456789abcdef")
+	name := chunks.next("0123456789abcdef")
+	if name != "data/soda/ts-00001-01234567.json.gz" {
+		t.Fatal("unexpected chunk name:", name)
+	}
+
+	config.Template = "{dir}/{nope}"
+	if config.validate() == nil {
+		t.Fatal("unknown placeholders should be rejected")
+	}
+}
+
+func TestFWRotatesByReadings(t *testing.T) {
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+
+	config := defaultOutputConfig()
+	config.RotateReadings = 2
+	chunks, err := newChunkFiles(config, TEST_OUTPUT_DIR+"/ts.json", defaultCompressionConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newFileWriter(defaultCompressionConfig(), chunks)
+
+	slot := &TimeSlot{Uuid: "a", StartTime: 0, EndTime: 10, Count: 5}
+	dataChan := make(chan *TimeseriesTuple, 5)
+	for i := 0; i < 5; i++ {
+		tuple := makeTimeseriesTuple(slot, []byte(`[{"uuid":"a","Readings":[[1,2]]}]`))
+		tuple.readings = 1
+		dataChan <- tuple
+	}
+	close(dataChan)
+
+	processErr := w.writeTimeseriesData(chunks.next("a"), dataChan)
+	if processErr != nil {
+		t.Fatal(processErr)
+	}
+
+	manifest, err := loadManifest(TEST_OUTPUT_DIR+"/"+MANIFEST_FILE, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Chunks) != 3 {
+		t.Fatal("expected 3 chunk files but got", len(manifest.Chunks))
+	}
+	if manifest.Chunks[2].File != TEST_OUTPUT_DIR+"/ts2.json" || manifest.Chunks[2].Readings != 1 || manifest.Chunks[0].Slots[0].Readings != 2 {
+		body, _ := json.Marshal(manifest)
+		t.Fatal("unexpected manifest:", string(body))
+	}
+	for _, chunk := range manifest.Chunks {
+		body, err := readDecompressedFile(chunk.File)
+		var data [][]*TimeseriesData
+		if err != nil || json.Unmarshal(body, &data) != nil || chunk.Bytes != int64(len(body)) {
+			t.Fatal("chunk", chunk.File, "is not a complete json file:", string(body))
+		}
+	}
+}
+
+func TestFWReportsFailedRotation(t *testing.T) {
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+
+	config := defaultOutputConfig()
+	config.RotateReadings = 1
+	config.Template = "{dir}/{chunk}/{name}.{ext}"
+	chunks, err := newChunkFiles(config, TEST_OUTPUT_DIR+"/ts.json", defaultCompressionConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newFileWriter(defaultCompressionConfig(), chunks)
+	os.MkdirAll(TEST_OUTPUT_DIR, os.ModePerm)
+	ioutil.WriteFile(TEST_OUTPUT_DIR+"/1", nil, 0644) //the directory of the next chunk file can not be created
+
+	slot := &TimeSlot{Uuid: "a", StartTime: 0, EndTime: 10, Count: 2}
+	dataChan := make(chan *TimeseriesTuple, 2)
+	for i := 0; i < 2; i++ {
+		tuple := makeTimeseriesTuple(slot, []byte(`[{"uuid":"a","Readings":[[1,2]]}]`))
+		tuple.readings = 1
+		dataChan <- tuple
+	}
+	close(dataChan)
+
+	processErr := w.writeTimeseriesData(chunks.next("a"), dataChan)
+	if processErr == nil || !strings.Contains(processErr.Error(), TEST_OUTPUT_DIR+"/1/ts.json") {
+		t.Fatal("the failed rotation should be reported with the file it could not open:", processErr)
+	}
+}
+
+func TestManifestChecksums(t *testing.T) {
+	os.MkdirAll(TEST_OUTPUT_DIR, os.ModePerm)
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+
+	file := TEST_OUTPUT_DIR + "/ts0.json"
+	ioutil.WriteFile(file, []byte("[]"), 0644)
+	manifest, _ := loadManifest(TEST_OUTPUT_DIR+"/"+MANIFEST_FILE, "test")
+	err := manifest.add(&ManifestChunk{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := loadManifest(TEST_OUTPUT_DIR+"/"+MANIFEST_FILE, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//sha256 of "[]"
+	if saved.Chunks[0].Sha256 != "4f53cda18c2baa0c0354bb5f9a3ecbe5ed12ab4d8e11ba873c2f11161202b945" || saved.Chunks[0].Bytes != 2 {
+		t.Fatal("unexpected checksum:", saved.Chunks[0].Sha256, saved.Chunks[0].Bytes)
+	}
+	if fileExists(TEST_OUTPUT_DIR + "/" + MANIFEST_FILE + ".tmp") {
+		t.Fatal("temporary manifest left behind")
+	}
+}
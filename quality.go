@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	QUALITY_REPORT = "dev/quality_report.json"
+	QUALITY_SUMMARY = "dev/quality_report.txt"
+	BUILDING_FIELD = "Metadata/Location/Building"
+	UNKNOWN_BUILDING = "unknown"
+	QUALITY_EXAMPLES = 10 //longest gaps and flatlines kept per uuid
+)
+
+/* Analysis of the readings passing through adm. Per uuid it finds gaps between
+ * readings longer than gap, runs of identical values lasting at least flatline,
+ * null and NaN values, timestamps earlier than the one before them and values
+ * outside the ranges. The report groups uuids by the metadata field at building.
+ */
+type QualityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Gap time.Duration `yaml:"gap"`
+	Flatline time.Duration `yaml:"flatline"` //0 disables flatline detection
+	Building string `yaml:"building"`
+	Ranges []RangeRule `yaml:"ranges"`
+	Report string `yaml:"report"`
+	Summary string `yaml:"summary"`
+}
+
+/* Expected bounds of the values of uuids whose metadata at the paths in match equal
+ * the given values, e.g. {"Properties/UnitofMeasure": "C"}. The first matching
+ * rule applies.
+ */
+type RangeRule struct {
+	Match map[string]string `yaml:"match"`
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+func defaultQualityConfig() QualityConfig {
+	return QualityConfig{
+		Gap: time.Hour,
+		Flatline: 24 * time.Hour,
+		Building: BUILDING_FIELD,
+		Report: QUALITY_REPORT,
+		Summary: QUALITY_SUMMARY,
+	}
+}
+
+func (c *QualityConfig) validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.Gap <= 0 || c.Flatline < 0 {
+		return fmt.Errorf("quality.gap must be positive and quality.flatline can not be negative")
+	}
+	for i, rule := range c.Ranges {
+		if rule.Min == nil && rule.Max == nil {
+			return fmt.Errorf("quality.ranges[%d] needs a min or a max", i)
+		}
+		if rule.Min != nil && rule.Max != nil && *rule.Min > *rule.Max {
+			return fmt.Errorf("quality.ranges[%d]: min is above max", i)
+		}
+	}
+	return nil
+}
+
+func (rule *RangeRule) contains(value float64) bool {
+	return (rule.Min == nil || value >= *rule.Min) && (rule.Max == nil || value <= *rule.Max)
+}
+
+/* Time span of a problem, in the timestamps of the readings. Value is the repeated
+ * value of a flatline.
+ */
+type QualityInterval struct {
+	Start int64 `json:"start"`
+	End int64 `json:"end"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func (i *QualityInterval) length() int64 {
+	return i.End - i.Start
+}
+
+/* Keeps the QUALITY_EXAMPLES longest intervals. */
+func addInterval(intervals []*QualityInterval, interval *QualityInterval) []*QualityInterval {
+	intervals = append(intervals, interval)
+	sort.SliceStable(intervals, func(i, j int) bool { return intervals[i].length() > intervals[j].length() })
+	if len(intervals) > QUALITY_EXAMPLES {
+		intervals = intervals[:QUALITY_EXAMPLES]
+	}
+	return intervals
+}
+
+type StreamQuality struct {
+	Uuid string `json:"uuid"`
+	Readings int64 `json:"readings"`
+	Nulls int64 `json:"nulls"`
+	NaNs int64 `json:"nans"`
+	OutOfOrder int64 `json:"out_of_order"`
+	OutOfRange int64 `json:"out_of_range"`
+	GapCount int64 `json:"gap_count"`
+	FlatlineCount int64 `json:"flatline_count"`
+	Gaps []*QualityInterval `json:"gaps,omitempty"` //longest first
+	Flatlines []*QualityInterval `json:"flatlines,omitempty"` //longest first
+
+	segments []*QualityInterval //first and last reading of every analyzed slot
+}
+
+func (s *StreamQuality) problems() int64 {
+	return s.Nulls + s.NaNs + s.OutOfOrder + s.OutOfRange + s.GapCount + s.FlatlineCount
+}
+
+func (s *StreamQuality) gap(interval *QualityInterval) {
+	s.GapCount++
+	s.Gaps = addInterval(s.Gaps, interval)
+}
+
+type BuildingQuality struct {
+	Uuids int `json:"uuids"`
+	Readings int64 `json:"readings"`
+	Nulls int64 `json:"nulls"`
+	NaNs int64 `json:"nans"`
+	OutOfOrder int64 `json:"out_of_order"`
+	OutOfRange int64 `json:"out_of_range"`
+	Gaps int64 `json:"gaps"`
+	Flatlines int64 `json:"flatlines"`
+	Streams []*StreamQuality `json:"streams"` //uuids with problems
+}
+
+type QualityReport struct {
+	Gap string `json:"gap"`
+	Flatline string `json:"flatline"`
+	Buildings map[string]*BuildingQuality `json:"buildings"`
+}
+
+/* Collects the analysis of every stream of tuples. Safe for concurrent use. */
+type QualityAnalyzer struct {
+	config QualityConfig
+	index *MetadataIndex
+	mutex sync.Mutex
+	streams map[string]*StreamQuality
+}
+
+func newQualityAnalyzer(config QualityConfig, index *MetadataIndex) (*QualityAnalyzer, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	index.require()
+	return &QualityAnalyzer{config: config, index: index, streams: make(map[string]*StreamQuality)}, nil
+}
+
+/* The range rule of a uuid, or nil. */
+func (q *QualityAnalyzer) rangeRule(uuid string) *RangeRule {
+	record, ok := q.index.lookup(uuid)
+	if !ok {
+		return nil
+	}
+	for i := range q.config.Ranges {
+		if matchesMetadata(record, q.config.Ranges[i].Match) {
+			return &q.config.Ranges[i]
+		}
+	}
+	return nil
+}
+
+/* Analysis state of one stream of tuples, per slot and uuid. Slots are read by one
+ * stream, so gaps and flatlines within a slot are found here. Gaps between slots
+ * are found when the report is built.
+ */
+type QualityCheck struct {
+	analyzer *QualityAnalyzer
+	streams map[dedupKey]*slotQuality
+}
+
+type slotQuality struct {
+	stream *StreamQuality
+	rule *RangeRule
+	first int64
+	last int64
+	flat *QualityInterval //current run of identical values
+}
+
+func (q *QualityAnalyzer) start() *QualityCheck {
+	return &QualityCheck{analyzer: q, streams: make(map[dedupKey]*slotQuality)}
+}
+
+/* Whether a raw value is NaN, written by some archivers as a string. */
+func isNaN(raw json.RawMessage) bool {
+	text := strings.Trim(string(raw), `"`)
+	if strings.EqualFold(text, "nan") {
+		return true
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	return err == nil && math.IsNaN(value)
+}
+
+/* Analyzes the readings of the tuple without changing it. */
+func (c *QualityCheck) add(tuple *TimeseriesTuple) error {
+	var timeseries []*TimeseriesData
+	err := json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range timeseries {
+		key := dedupKey{tuple.slot, data.Uuid}
+		slot, ok := c.streams[key]
+		if !ok {
+			slot = &slotQuality{
+				stream: &StreamQuality{Uuid: data.Uuid},
+				rule: c.analyzer.rangeRule(data.Uuid),
+			}
+			c.streams[key] = slot
+		}
+		for _, reading := range data.Readings {
+			t, err := readingTime(reading)
+			if err != nil {
+				return err
+			}
+			c.analyzer.check(slot, t, reading)
+		}
+	}
+	return nil
+}
+
+func (q *QualityAnalyzer) check(slot *slotQuality, t int64, reading []json.RawMessage) {
+	stream := slot.stream
+	if stream.Readings == 0 {
+		slot.first, slot.last = t, t
+	} else if t < slot.last {
+		stream.OutOfOrder++
+	} else {
+		if t - slot.last > int64(q.config.Gap) {
+			stream.gap(&QualityInterval{Start: slot.last, End: t})
+		}
+		slot.last = t
+	}
+	if t < slot.first {
+		slot.first = t
+	}
+	stream.Readings++
+
+	if len(reading) < 2 || string(reading[1]) == "null" {
+		stream.Nulls++
+		return
+	}
+	value := reading[1]
+	if isNaN(value) {
+		stream.NaNs++
+		return
+	}
+
+	if slot.rule != nil {
+		number, err := strconv.ParseFloat(string(value), 64)
+		if err == nil && !slot.rule.contains(number) {
+			stream.OutOfRange++
+		}
+	}
+
+	if q.config.Flatline == 0 || t < slot.last {
+		return
+	}
+	if slot.flat != nil && bytes.Equal(slot.flat.Value, value) {
+		slot.flat.End = t
+		return
+	}
+	q.closeFlatline(slot)
+	slot.flat = &QualityInterval{Start: t, End: t, Value: value}
+}
+
+func (q *QualityAnalyzer) closeFlatline(slot *slotQuality) {
+	if slot.flat != nil && slot.flat.length() >= int64(q.config.Flatline) {
+		slot.stream.FlatlineCount++
+		slot.stream.Flatlines = addInterval(slot.stream.Flatlines, slot.flat)
+	}
+	slot.flat = nil
+}
+
+/* Adds the analysis of the stream's slots to the analyzer. Called once the stream ends. */
+func (c *QualityCheck) finish() {
+	q := c.analyzer
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, slot := range c.streams {
+		q.closeFlatline(slot)
+		found := slot.stream
+		stream, ok := q.streams[found.Uuid]
+		if !ok {
+			stream = &StreamQuality{Uuid: found.Uuid}
+			q.streams[found.Uuid] = stream
+		}
+		stream.Readings += found.Readings
+		stream.Nulls += found.Nulls
+		stream.NaNs += found.NaNs
+		stream.OutOfOrder += found.OutOfOrder
+		stream.OutOfRange += found.OutOfRange
+		stream.GapCount += found.GapCount
+		stream.FlatlineCount += found.FlatlineCount
+		for _, gap := range found.Gaps {
+			stream.Gaps = addInterval(stream.Gaps, gap)
+		}
+		for _, flatline := range found.Flatlines {
+			stream.Flatlines = addInterval(stream.Flatlines, flatline)
+		}
+		if found.Readings > 0 {
+			stream.segments = append(stream.segments, &QualityInterval{Start: slot.first, End: slot.last})
+		}
+	}
+	c.streams = make(map[dedupKey]*slotQuality)
+}
+
+/* Building of a uuid according to its metadata. */
+func (q *QualityAnalyzer) building(uuid string) string {
+	record, ok := q.index.lookup(uuid)
+	if !ok {
+		return UNKNOWN_BUILDING
+	}
+	value, ok := record.get(q.config.Building)
+	building, isString := value.(string)
+	if !ok || !isString || building == "" {
+		return UNKNOWN_BUILDING
+	}
+	return building
+}
+
+func (q *QualityAnalyzer) readings() int64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	var readings int64
+	for _, stream := range q.streams {
+		readings += stream.Readings
+	}
+	return readings
+}
+
+/* Finds the gaps between slots and groups the streams by building. */
+func (q *QualityAnalyzer) report() *QualityReport {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	report := &QualityReport{
+		Gap: q.config.Gap.String(),
+		Flatline: q.config.Flatline.String(),
+		Buildings: make(map[string]*BuildingQuality),
+	}
+
+	uuids := make([]string, 0, len(q.streams))
+	for uuid := range q.streams {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+
+	for _, uuid := range uuids {
+		stream := q.streams[uuid]
+		segments := stream.segments
+		sort.Slice(segments, func(i, j int) bool { return segments[i].Start < segments[j].Start })
+		for i := 1; i < len(segments); i++ {
+			if segments[i].Start - segments[i-1].End > int64(q.config.Gap) {
+				stream.gap(&QualityInterval{Start: segments[i-1].End, End: segments[i].Start})
+			}
+		}
+		stream.segments = nil
+
+		name := q.building(uuid)
+		building, ok := report.Buildings[name]
+		if !ok {
+			building = &BuildingQuality{Streams: make([]*StreamQuality, 0)}
+			report.Buildings[name] = building
+		}
+		building.Uuids++
+		building.Readings += stream.Readings
+		building.Nulls += stream.Nulls
+		building.NaNs += stream.NaNs
+		building.OutOfOrder += stream.OutOfOrder
+		building.OutOfRange += stream.OutOfRange
+		building.Gaps += stream.GapCount
+		building.Flatlines += stream.FlatlineCount
+		if stream.problems() > 0 {
+			building.Streams = append(building.Streams, stream)
+		}
+	}
+	return report
+}
+
+func formatQualityTime(t int64) string {
+	return time.Unix(0, t).UTC().Format(time.RFC3339)
+}
+
+/* Human readable summary of the report, one section per building. */
+func (r *QualityReport) summary() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Data quality report. Gaps longer than %s, flatlines lasting at least %s.\n", r.Gap, r.Flatline)
+
+	names := make([]string, 0, len(r.Buildings))
+	for name := range r.Buildings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		building := r.Buildings[name]
+		fmt.Fprintf(&b, "\n%s: %d uuids, %d readings, %d uuids with problems\n", name, building.Uuids, building.Readings, len(building.Streams))
+		fmt.Fprintf(&b, "  gaps: %d, flatlines: %d, null: %d, NaN: %d, out of order: %d, out of range: %d\n",
+			building.Gaps, building.Flatlines, building.Nulls, building.NaNs, building.OutOfOrder, building.OutOfRange)
+		for _, stream := range building.Streams {
+			fmt.Fprintf(&b, "  %s: gaps: %d, flatlines: %d, null: %d, NaN: %d, out of order: %d, out of range: %d\n",
+				stream.Uuid, stream.GapCount, stream.FlatlineCount, stream.Nulls, stream.NaNs, stream.OutOfOrder, stream.OutOfRange)
+			if len(stream.Gaps) > 0 {
+				gap := stream.Gaps[0]
+				fmt.Fprintf(&b, "    longest gap: %s from %s to %s\n", time.Duration(gap.length()), formatQualityTime(gap.Start), formatQualityTime(gap.End))
+			}
+			if len(stream.Flatlines) > 0 {
+				flat := stream.Flatlines[0]
+				fmt.Fprintf(&b, "    longest flatline: %s at %s from %s to %s\n", time.Duration(flat.length()), string(flat.Value), formatQualityTime(flat.Start), formatQualityTime(flat.End))
+			}
+		}
+	}
+	return b.String()
+}
+
+/* Writes the json report and the summary. */
+func (r *QualityReport) save(config QualityConfig) error {
+	body, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(config.Report), os.ModePerm)
+	err = writeFileAtomic(config.Report, body)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(config.Summary), os.ModePerm)
+	return writeFileAtomic(config.Summary, []byte(r.summary()))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestQualityPipeline(t *testing.T) *Pipeline {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	config := defaultQualityConfig()
+	config.Enabled = true
+	config.Gap = 10
+	config.Flatline = 3
+	max := 50.0
+	config.Ranges = []RangeRule{{Match: map[string]string{"Properties/UnitofMeasure": "C"}, Max: &max}}
+	err := pipeline.analyze(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := &Metadata{Uuid: "a"}
+	record.set("Properties/UnitofMeasure", "C")
+	record.set("Metadata/Location/Building", "Soda")
+	pipeline.index.observe(record)
+	return pipeline
+}
+
+func TestQualityFindsProblems(t *testing.T) {
+	pipeline := newTestQualityPipeline(t)
+	first := &TimeSlot{Uuid: "a", StartTime: 0, EndTime: 100}
+	second := &TimeSlot{Uuid: "a", StartTime: 100, EndTime: -1}
+	tuples := []*TimeseriesTuple{
+		makeTimeseriesTuple(first, []byte(`[{"uuid":"a","Readings":[[0,1],[1,2],[2,2],[3,2],[5,2],[30,60],[29,1]]}]`)),
+		makeTimeseriesTuple(first, []byte(`[{"uuid":"a","Readings":[[31,null],[32,"NaN"]]}]`)),
+		makeTimeseriesTuple(second, []byte(`[{"uuid":"a","Readings":[[100,1]]}]`)),
+		makeTimeseriesTuple(second, []byte(`[{"uuid":"b","Readings":[[0,1],[1,1]]}]`)),
+	}
+	for i, readings := range []int64{7, 2, 1, 2} {
+		tuples[i].readings = readings
+	}
+	written := runTestTimeseries(pipeline, tuples...)
+	if len(written) != 4 {
+		t.Fatal("the analysis should not change the readings:", written)
+	}
+
+	report := pipeline.analyzer.report()
+	soda := report.Buildings["Soda"]
+	if soda == nil || soda.Uuids != 1 || len(soda.Streams) != 1 {
+		t.Fatal("expected one uuid in Soda:", report.Buildings)
+	}
+	stream := soda.Streams[0]
+	if stream.Readings != 10 || stream.Nulls != 1 || stream.NaNs != 1 || stream.OutOfOrder != 1 || stream.OutOfRange != 1 {
+		t.Fatal("unexpected counts:", stream)
+	}
+	if stream.GapCount != 2 || stream.Gaps[0].Start != 32 || stream.Gaps[0].End != 100 || stream.Gaps[1].Start != 5 {
+		t.Fatal("expected a gap within and one between slots:", stream.GapCount, stream.Gaps)
+	}
+	if stream.FlatlineCount != 1 || stream.Flatlines[0].Start != 1 || stream.Flatlines[0].End != 5 || string(stream.Flatlines[0].Value) != "2" {
+		t.Fatal("expected a flatline of 2 from 1 to 5:", stream.Flatlines)
+	}
+
+	unknown := report.Buildings[UNKNOWN_BUILDING]
+	if unknown == nil || unknown.Uuids != 1 || len(unknown.Streams) != 0 {
+		t.Fatal("b has no metadata and no problems:", unknown)
+	}
+	if summary := report.summary(); !strings.Contains(summary, "Soda: 1 uuids, 10 readings, 1 uuids with problems") {
+		t.Fatal("unexpected summary:", summary)
+	}
+}
+
+func TestQualityConfig(t *testing.T) {
+	min, max := 10.0, 0.0
+	bad := []QualityConfig{
+		{Enabled: true, Gap: 0},
+		{Enabled: true, Gap: time.Hour, Flatline: -1},
+		{Enabled: true, Gap: time.Hour, Ranges: []RangeRule{{}}},
+		{Enabled: true, Gap: time.Hour, Ranges: []RangeRule{{Min: &min, Max: &max}}},
+	}
+	for _, config := range bad {
+		if config.validate() == nil {
+			t.Fatal("config should be rejected:", config)
+		}
+	}
+	config := defaultQualityConfig()
+	if config.validate() != nil {
+		t.Fatal("the default config should be valid")
+	}
+}
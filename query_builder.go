@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+/* Builds queries in the Giles query language. Values are validated and quoted
+ * here rather than pasted into query strings by callers, so a malformed uuid
+ * fails to build instead of breaking or altering the query.
+ *
+ *	query, err := newDataQuery().in(start, end).limit(100).as("ns").whereUuids(uuid).build()
+ */
+type QueryBuilder struct {
+	selector string
+	hasRange bool
+	start int64
+	end int64
+	limitCount int
+	unit string
+	uuids []string
+	err error
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	tagPattern = regexp.MustCompile(`^[A-Za-z0-9_]+(/[A-Za-z0-9_]+)*$`)
+	widthPattern = regexp.MustCompile(`^[0-9]+(ns|us|ms|s|m|h|d|w|y)$`)
+	unitPattern = regexp.MustCompile(`^(ns|us|ms|s)$`)
+)
+
+/* select data in (start, end) */
+func newDataQuery() *QueryBuilder {
+	return &QueryBuilder{selector: "data"}
+}
+
+/* select window(width) data in (start, end). width is e.g. "365d". */
+func newWindowQuery(width string) *QueryBuilder {
+	q := &QueryBuilder{selector: "window(" + width + ") data"}
+	if !widthPattern.MatchString(width) {
+		q.fail("bad window width %q", width)
+	}
+	return q
+}
+
+/* select statistical(width) data in (start, end). Each reading is one bucket of
+ * width, [time, count, min, mean, max].
+ */
+func newStatisticalQuery(width string) *QueryBuilder {
+	q := &QueryBuilder{selector: "statistical(" + width + ") data"}
+	if !widthPattern.MatchString(width) {
+		q.fail("bad statistical width %q", width)
+	}
+	return q
+}
+
+/* select * */
+func newMetadataQuery() *QueryBuilder {
+	return &QueryBuilder{selector: "*"}
+}
+
+/* select distinct tag, e.g. "uuid" or "Metadata/SourceName". */
+func newDistinctQuery(tag string) *QueryBuilder {
+	q := &QueryBuilder{selector: "distinct " + tag}
+	if !tagPattern.MatchString(tag) {
+		q.fail("bad tag %q", tag)
+	}
+	return q
+}
+
+/* Restricts the query to the nanosecond time range (start, end). An end of -1 means now. */
+func (q *QueryBuilder) in(start int64, end int64) *QueryBuilder {
+	q.hasRange = true
+	q.start = start
+	q.end = end
+	if start < 0 || end < -1 {
+		q.fail("bad time range (%d, %d)", start, end)
+	}
+	return q
+}
+
+func (q *QueryBuilder) limit(n int) *QueryBuilder {
+	q.limitCount = n
+	if n < 0 {
+		q.fail("bad limit %d", n)
+	}
+	return q
+}
+
+/* Sets the unit timestamps are returned in: ns, us, ms or s. */
+func (q *QueryBuilder) as(unit string) *QueryBuilder {
+	q.unit = unit
+	if !unitPattern.MatchString(unit) {
+		q.fail("bad time unit %q", unit)
+	}
+	return q
+}
+
+/* Restricts the query to streams with any of the given uuids. */
+func (q *QueryBuilder) whereUuids(uuids ...string) *QueryBuilder {
+	for _, uuid := range uuids {
+		if !validUuid(uuid) {
+			q.fail("bad uuid %q", uuid)
+		}
+	}
+	q.uuids = append(q.uuids, uuids...)
+	return q
+}
+
+func (q *QueryBuilder) build() (string, error) {
+	if q.err != nil {
+		return "", q.err
+	}
+	if q.hasRange && q.selector == "*" {
+		return "", fmt.Errorf("query: metadata queries take no time range")
+	}
+
+	query := "select " + q.selector
+	if q.hasRange {
+		query += " in (" + formatQueryTime(q.start) + ", " + formatQueryTime(q.end) + ")"
+	}
+	if q.limitCount > 0 {
+		query += " limit " + strconv.Itoa(q.limitCount)
+	}
+	if q.unit != "" {
+		query += " as " + q.unit
+	}
+
+	for i, uuid := range q.uuids {
+		if i == 0 {
+			query += " where "
+		} else {
+			query += " or "
+		}
+		query += "uuid = " + quoteValue(uuid)
+	}
+	return query, nil
+}
+
+/* Keeps the first error so build can report it. */
+func (q *QueryBuilder) fail(format string, args ...interface{}) {
+	if q.err == nil {
+		q.err = fmt.Errorf("query: "+format, args...)
+	}
+}
+
+func validUuid(uuid string) bool {
+	return uuidPattern.MatchString(uuid)
+}
+
+/* Quotes a string literal, escaping backslashes and single quotes. */
+func quoteValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
+
+/* Formats a nanosecond timestamp for a query time range. -1 means now. */
+func formatQueryTime(t int64) string {
+	if t == -1 {
+		return "now"
+	}
+	return strconv.FormatInt(t, 10) + "ns"
+}
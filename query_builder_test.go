@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+const (
+	TEST_QUERY_UUID = "174fb37a-5a5f-57a8-bc60-14746cb4656f"
+	TEST_QUERY_UUID2 = "fea0230b-c64b-53cd-9640-4e5cceebb7a8"
+)
+
+func testBuild(t *testing.T, q *QueryBuilder, expected string) {
+	query, err := q.build()
+	if err != nil {
+		t.Fatal("unexpected error:", err)
+	}
+	if query != expected {
+		t.Fatal("expected query\n", expected, "\nbut got\n", query)
+	}
+}
+
+func testBuildFails(t *testing.T, q *QueryBuilder) {
+	query, err := q.build()
+	if err == nil {
+		t.Fatal("expected an error but built", query)
+	}
+}
+
+func TestQueryBuilderDistinct(t *testing.T) {
+	testBuild(t, newDistinctQuery("uuid"), "select distinct uuid")
+	testBuild(t, newDistinctQuery("Metadata/SourceName"), "select distinct Metadata/SourceName")
+	testBuildFails(t, newDistinctQuery("uuid; delete"))
+}
+
+func TestQueryBuilderMetadata(t *testing.T) {
+	testBuild(t, newMetadataQuery().whereUuids(TEST_QUERY_UUID),
+		"select * where uuid = '"+TEST_QUERY_UUID+"'")
+	testBuild(t, newMetadataQuery().whereUuids(TEST_QUERY_UUID, TEST_QUERY_UUID2),
+		"select * where uuid = '"+TEST_QUERY_UUID+"' or uuid = '"+TEST_QUERY_UUID2+"'")
+	testBuildFails(t, newMetadataQuery().in(0, -1))
+}
+
+func TestQueryBuilderWindow(t *testing.T) {
+	testBuild(t, newWindowQuery("365d").in(0, -1).whereUuids(TEST_QUERY_UUID),
+		"select window(365d) data in (0ns, now) where uuid = '"+TEST_QUERY_UUID+"'")
+	testBuildFails(t, newWindowQuery("365 days"))
+}
+
+func TestQueryBuilderStatistical(t *testing.T) {
+	testBuild(t, newStatisticalQuery("900s").in(0, 3600000000000).as("ns").whereUuids(TEST_QUERY_UUID),
+		"select statistical(900s) data in (0ns, 3600000000000ns) as ns where uuid = '"+TEST_QUERY_UUID+"'")
+	testBuildFails(t, newStatisticalQuery("15 minutes"))
+}
+
+func TestQueryBuilderData(t *testing.T) {
+	testBuild(t, newDataQuery().in(10, 20).limit(5).as("ns").whereUuids(TEST_QUERY_UUID),
+		"select data in (10ns, 20ns) limit 5 as ns where uuid = '"+TEST_QUERY_UUID+"'")
+	testBuildFails(t, newDataQuery().in(-5, 20))
+	testBuildFails(t, newDataQuery().as("fortnights"))
+	testBuildFails(t, newDataQuery().limit(-1))
+}
+
+func TestQueryBuilderRejectsBadUuids(t *testing.T) {
+	bad := []string{
+		"",
+		"174fb37a",
+		TEST_QUERY_UUID + "' or uuid like '%",
+		"174fb37a-5a5f-57a8-bc60-14746cb4656g",
+		" " + TEST_QUERY_UUID,
+	}
+	for _, uuid := range bad {
+		testBuildFails(t, newMetadataQuery().whereUuids(uuid))
+		testBuildFails(t, newMetadataQuery().whereUuids(TEST_QUERY_UUID, uuid))
+	}
+}
+
+func TestQueryBuilderQuoteValue(t *testing.T) {
+	if quoteValue(`it's`) != `'it\'s'` {
+		t.Fatal("single quotes should be escaped:", quoteValue(`it's`))
+	}
+	if quoteValue(`a\`) != `'a\\'` {
+		t.Fatal("backslashes should be escaped:", quoteValue(`a\`))
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+/* Makes queries against an archiver endpoint, retrying according to a RetryPolicy.
+ * A QueryClient is safe for concurrent use and is shared by every reader call.
+ */
+type QueryClient struct {
+	policy RetryPolicy
+	endpoint EndpointConfig
+	breaker *CircuitBreaker
+	limiter *RateLimiter
+	concurrency *AdaptiveSema
+	client *http.Client
+}
+
+func newQueryClient(policy RetryPolicy, endpoint EndpointConfig, breaker *CircuitBreaker, limiter *RateLimiter, concurrency *AdaptiveSema) (*QueryClient, error) {
+	client, err := endpoint.httpClient(policy.RequestTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &QueryClient{
+		policy: policy,
+		endpoint: endpoint,
+		breaker: breaker,
+		limiter: limiter,
+		concurrency: concurrency,
+		client: client,
+	}, nil
+}
+
+/* Makes an HTTP POST request to the specified url with the specified queryString.
+ * Return value is of type []byte. It is up to the calling function to convert
+ * []byte into the appropriate type.
+ */
+func (c *QueryClient) makeQuery(url string, queryString string) ([]byte, error) {
+	var body []byte
+	err := c.query(url, queryString, func(r io.Reader) error {
+		var err error
+		body, err = ioutil.ReadAll(r)
+		return err
+	}, true)
+	return body, err
+}
+
+/* Like makeQuery but hands the response body to decode as it arrives instead of
+ * buffering it. Failures to connect or bad statuses are retried, but a failure
+ * inside decode is not since decode may already have passed data on.
+ */
+func (c *QueryClient) streamQuery(url string, queryString string, decode func(io.Reader) error) error {
+	return c.query(url, queryString, decode, false)
+}
+
+/* Attempts that fail while the circuit breaker is open are not counted against
+ * the retry policy; the query waits for the source to recover instead.
+ * Failed queries return a *QueryError describing the kind of failure.
+ */
+func (c *QueryClient) query(url string, queryString string, handle func(io.Reader) error, retryBody bool) error {
+	attempts := c.policy.attempts()
+	for i := 0; i < attempts; {
+		err := c.breaker.wait()
+		if err != nil {
+			return &QueryError{kind: QE_SERVER, message: err.Error(), url: url, query: queryString}
+		}
+
+		latency, queryErr := c.attempt(url, queryString, handle, retryBody)
+		c.breaker.record(queryErr == nil || queryErr.kind != QE_SERVER)
+		c.concurrency.observe(latency, queryErr != nil && queryErr.kind == QE_SERVER)
+		if queryErr == nil {
+			return nil
+		}
+		queryErr.url = url
+		queryErr.query = queryString
+		if !queryErr.retryable {
+			return queryErr
+		}
+
+		if c.breaker.isOpen() {
+			log.Println("makeQuery: source unavailable, requeueing query until it recovers err:", queryErr)
+			continue
+		}
+
+		i++
+		if i == attempts {
+			return queryErr
+		}
+		wait := c.policy.backoff(i)
+		log.Println("makeQuery: retrying in", wait, "err:", queryErr)
+		time.Sleep(wait)
+	}
+	return &QueryError{kind: QE_CLIENT, message: "no attempts made", url: url, query: queryString}
+}
+
+/* Makes a single request and classifies the response. The latency returned is
+ * the time spent waiting on the source: the request up to the response headers
+ * and the reads of the body. Rate limiting and the time handle spends passing
+ * data on are not the source's doing and are left out.
+ */
+func (c *QueryClient) attempt(url string, queryString string, handle func(io.Reader) error, retryBody bool) (latency time.Duration, queryErr *QueryError) {
+	req, err := http.NewRequest("POST", url, bytes.NewBufferString(queryString))
+	if err != nil {
+		return 0, &QueryError{kind: QE_CLIENT, message: "could not create request: " + err.Error()}
+	}
+	c.endpoint.authorize(req)
+
+	c.limiter.waitQuery()
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	latency = time.Since(start)
+	if err != nil {
+		return latency, &QueryError{kind: QE_SERVER, message: "failed to execute request: " + err.Error(), retryable: c.policy.RetryNetworkErrors}
+	}
+	body := &countingReader{reader: resp.Body}
+	defer func() {
+		io.CopyN(ioutil.Discard, body, ERROR_BODY_LIMIT) //lets the connection be reused
+		resp.Body.Close()
+		c.limiter.consumeBytes(int(body.count))
+		latency += body.elapsed
+	}()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, archiver := classifyErrorBody(body)
+		switch {
+		case archiver:
+			return latency, &QueryError{kind: QE_ARCHIVER, status: resp.StatusCode, message: message}
+		case resp.StatusCode >= 500 || c.policy.retryableStatus(resp.StatusCode):
+			return latency, &QueryError{kind: QE_SERVER, status: resp.StatusCode, message: message, retryable: c.policy.retryableStatus(resp.StatusCode)}
+		default:
+			return latency, &QueryError{kind: QE_CLIENT, status: resp.StatusCode, message: message}
+		}
+	}
+
+	reader, queryErr := classifySuccessBody(body)
+	if queryErr != nil {
+		queryErr.retryable = queryErr.retryable && retryBody
+		return latency, queryErr
+	}
+
+	err = handle(reader)
+	if err != nil {
+		return latency, classifyBodyError(err, body.err, retryBody && c.policy.RetryNetworkErrors)
+	}
+	return latency, nil
+}
+
+/* Counts the bytes read through it so they can be charged to the rate limiter,
+ * and the time spent waiting for them. err is the first read failure other than
+ * the end of the body.
+ */
+type countingReader struct {
+	reader io.Reader
+	count int64
+	elapsed time.Duration
+	err error
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := r.reader.Read(p)
+	r.elapsed += time.Since(start)
+	r.count += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
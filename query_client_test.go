@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestQueryClient() *QueryClient {
+	policy := defaultRetryPolicy()
+	policy.BaseBackoff = time.Millisecond
+	policy.MaxBackoff = 5 * time.Millisecond
+	client, _ := newQueryClient(policy, defaultEndpointConfig(), nil, nil, nil)
+	return client
+}
+
+func newTestServer(statuses []int, body string) (*httptest.Server, *int) {
+	calls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return server, &calls
+}
+
+func TestRetryBackoffBounds(t *testing.T) {
+	policy := defaultRetryPolicy()
+	policy.Jitter = 0
+	if policy.backoff(0) != 0 {
+		t.Fatal("first attempt should not wait")
+	}
+	if policy.backoff(1) != time.Second || policy.backoff(2) != 2*time.Second {
+		t.Fatal("backoff should double:", policy.backoff(1), policy.backoff(2))
+	}
+	if policy.backoff(20) != policy.MaxBackoff {
+		t.Fatal("backoff should be capped at", policy.MaxBackoff, "but was", policy.backoff(20))
+	}
+
+	policy.MaxBackoff = 0
+	if d := policy.backoff(100); d <= 0 {
+		t.Fatal("backoff without a cap should not overflow:", d)
+	}
+	policy.MaxBackoff = defaultRetryPolicy().MaxBackoff
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := policy.backoff(1)
+		if d < 500*time.Millisecond || d > 1500*time.Millisecond {
+			t.Fatal("jittered backoff out of range:", d)
+		}
+	}
+}
+
+func TestQueryRetriesServerErrors(t *testing.T) {
+	server, calls := newTestServer([]int{500, 503, 200}, "[]")
+	defer server.Close()
+
+	body, err := newTestQueryClient().makeQuery(server.URL, "select distinct uuid")
+	if err != nil {
+		t.Fatal("query should succeed on third attempt:", err)
+	}
+	if string(body) != "[]" || *calls != 3 {
+		t.Fatal("unexpected body", string(body), "after", *calls, "calls")
+	}
+}
+
+func TestQueryDoesNotRetryClientErrors(t *testing.T) {
+	server, calls := newTestServer([]int{400}, "bad query")
+	defer server.Close()
+
+	_, err := newTestQueryClient().makeQuery(server.URL, "select distinct uuid")
+	if err == nil {
+		t.Fatal("400 should not be treated as success")
+	}
+	if *calls != 1 {
+		t.Fatal("400 should not be retried but made", *calls, "calls")
+	}
+}
+
+func TestQueryGivesUpAfterMaxAttempts(t *testing.T) {
+	server, calls := newTestServer([]int{500}, "")
+	defer server.Close()
+
+	_, err := newTestQueryClient().makeQuery(server.URL, "select distinct uuid")
+	if err == nil {
+		t.Fatal("persistent 500s should fail")
+	}
+	if *calls != 3 {
+		t.Fatal("expected 3 attempts but made", *calls)
+	}
+}
+
+func TestQueryClassifiesResponses(t *testing.T) {
+	cases := []struct {
+		status int
+		body string
+		kind QueryErrorKind
+		calls int
+	}{
+		{200, `{"error": "bad query"}`, QE_ARCHIVER, 1},
+		{400, `{"error": "bad query"}`, QE_ARCHIVER, 1},
+		{404, "not found", QE_CLIENT, 1},
+		{200, "<html><body>Bad Gateway</body></html>", QE_RESPONSE, 1},
+		{503, "", QE_SERVER, 3},
+	}
+
+	for _, c := range cases {
+		server, calls := newTestServer([]int{c.status}, c.body)
+		_, err := newTestQueryClient().makeQuery(server.URL, "select distinct uuid")
+		server.Close()
+
+		if queryErrorKind(err) != c.kind {
+			t.Fatal("expected", c.kind, "error for", c.status, c.body, "but got", err)
+		}
+		if *calls != c.calls {
+			t.Fatal("expected", c.calls, "calls for", c.status, c.body, "but made", *calls)
+		}
+	}
+}
+
+func TestQueryPassesArrays(t *testing.T) {
+	server, _ := newTestServer([]int{200}, ` [{"uuid": "a"}]`)
+	defer server.Close()
+
+	body, err := newTestQueryClient().makeQuery(server.URL, "select * where uuid = 'a'")
+	if err != nil || string(body) != `[{"uuid": "a"}]` {
+		t.Fatal("json array should be returned as is:", string(body), err)
+	}
+}
+
+func TestQueryLatencyExcludesThrottlingAndHandling(t *testing.T) {
+	server, _ := newTestServer([]int{200}, "[]")
+	defer server.Close()
+
+	config := defaultConcurrencyConfig()
+	config.Initial, config.Max = 4, 4
+	config.Window = 1
+	config.TargetLatency = 50 * time.Millisecond
+	concurrency := newAdaptiveSema(config)
+	client := newTestQueryClient()
+	client.concurrency = concurrency
+	client.limiter = newRateLimiter(RateLimitConfig{QueriesPerSecond: 10})
+
+	for i := 0; i < 3; i++ {
+		err := client.streamQuery(server.URL, "select data", func(r io.Reader) error {
+			time.Sleep(100 * time.Millisecond) //a slow writer downstream
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if concurrency.currentLimit() != 4 {
+		t.Fatal("slow handling and rate limiting should not reduce the limit but it is", concurrency.currentLimit())
+	}
+}
+
+func TestQueryDoesNotRetryBadData(t *testing.T) {
+	server, calls := newTestServer([]int{200}, `[{"uuid": "a", "Readings": [["x", 1]]}]`)
+	defer server.Close()
+
+	err := newTestQueryClient().query(server.URL, "select data", func(r io.Reader) error {
+		ioutil.ReadAll(r)
+		return fmt.Errorf("bad timestamp \"x\"")
+	}, true)
+	if queryErrorKind(err) != QE_RESPONSE || isTransient(err) {
+		t.Fatal("data that can not be handled should fail as a bad response:", err)
+	}
+	if *calls != 1 {
+		t.Fatal("bad data should not be queried again but made", *calls, "calls")
+	}
+}
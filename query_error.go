@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+type QueryErrorKind uint8
+
+/* Classes of failed queries */
+const (
+	QE_SERVER QueryErrorKind = iota + 1 //5xx, timeouts and dropped connections. May succeed if retried.
+	QE_CLIENT                           //4xx. The request itself is wrong and will fail again.
+	QE_ARCHIVER                         //the archiver answered with an {"error": ...} payload, e.g. a bad query
+	QE_RESPONSE                         //the response was not what was asked for, e.g. an HTML page or truncated json
+)
+
+/* Bound on how much of an error response is kept for the message. */
+const ERROR_BODY_LIMIT = 64 << 10
+
+type QueryError struct {
+	kind QueryErrorKind
+	status int
+	message string
+	url string
+	query string
+	retryable bool
+}
+
+func (e *QueryError) Error() string {
+	status := ""
+	if e.status != 0 {
+		status = fmt.Sprint(" status ", e.status)
+	}
+	return fmt.Sprintf("makeQuery: %s error%s from %s for %s: %s", e.kind, status, e.url, e.query, e.message)
+}
+
+func (k QueryErrorKind) String() string {
+	switch k {
+	case QE_SERVER:
+		return "server"
+	case QE_CLIENT:
+		return "client"
+	case QE_ARCHIVER:
+		return "archiver query"
+	case QE_RESPONSE:
+		return "bad response"
+	default:
+		return "unknown"
+	}
+}
+
+/* Returns the kind of the QueryError wrapped in err, or 0 if there is none. */
+func queryErrorKind(err error) QueryErrorKind {
+	var queryErr *QueryError
+	if errors.As(err, &queryErr) {
+		return queryErr.kind
+	}
+	return 0
+}
+
+/* Reports whether err is a failure of the source that may clear up on its own,
+ * as opposed to a permanent problem with the query or the data.
+ */
+func isTransient(err error) bool {
+	return queryErrorKind(err) == QE_SERVER
+}
+
+/* A failed uuid or slot together with the error that failed it. Readers put these
+ * in ProcessError.Failed() so callers can tell transient failures from permanent ones.
+ */
+type FailedItem struct {
+	item interface{}
+	err error
+}
+
+func newFailedItem(item interface{}, err error) *FailedItem {
+	return &FailedItem{
+		item: item,
+		err: err,
+	}
+}
+
+/* Returns the uuid or slot of an entry of ProcessError.Failed() and the error that
+ * failed it, if known.
+ */
+func unwrapFailed(failed interface{}) (interface{}, error) {
+	if f, ok := failed.(*FailedItem); ok {
+		return f.item, f.err
+	}
+	return failed, nil
+}
+
+/* Reads the start of an error response and looks for an archiver error payload. */
+func classifyErrorBody(body io.Reader) (string, bool) {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, ERROR_BODY_LIMIT))
+	if message, ok := archiverError(data); ok {
+		return message, true
+	}
+	return string(data), false
+}
+
+/* Checks the first byte of a successful response. Giles answers queries with a
+ * json array, so an object is either an archiver error payload or unexpected, and
+ * anything starting with '<' is an HTML page from a proxy or error handler.
+ * Returns a reader positioned at the start of the body.
+ */
+func classifySuccessBody(body io.Reader) (io.Reader, *QueryError) {
+	reader := bufio.NewReader(body)
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			return reader, nil //empty or unreadable. left to the caller to report.
+		}
+
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			reader.ReadByte()
+			continue
+		case '<':
+			start, _ := reader.Peek(80)
+			return nil, &QueryError{kind: QE_RESPONSE, message: "received html instead of json: " + string(start)}
+		case '{':
+			data, err := ioutil.ReadAll(reader)
+			if err != nil {
+				return nil, &QueryError{kind: QE_SERVER, message: err.Error(), retryable: true}
+			}
+			if message, ok := archiverError(data); ok {
+				return nil, &QueryError{kind: QE_ARCHIVER, message: message}
+			}
+			return bytes.NewReader(data), nil
+		}
+		return reader, nil
+	}
+}
+
+func archiverError(data []byte) (string, bool) {
+	var payload struct {
+		Error interface{} `json:"error"`
+	}
+	err := json.Unmarshal(data, &payload)
+	if err != nil || payload.Error == nil {
+		return "", false
+	}
+	return fmt.Sprint(payload.Error), true
+}
+
+/* Wraps a failure to unmarshal a response that the client accepted. */
+func newResponseError(url string, query string, err error) *QueryError {
+	return &QueryError{kind: QE_RESPONSE, message: err.Error(), url: url, query: query}
+}
+
+/* Classifies an error returned while reading or decoding a response body. Only
+ * readErr, the failure of a read from the connection, is the server's doing. Errors
+ * of the decoding or handling of the data, e.g. a bad timestamp, fail again if the
+ * query is retried.
+ */
+func classifyBodyError(err error, readErr error, retryable bool) *QueryError {
+	if readErr == nil {
+		return &QueryError{kind: QE_RESPONSE, message: err.Error()}
+	}
+	return &QueryError{kind: QE_SERVER, message: "failed to read response body: " + readErr.Error(), retryable: retryable}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/* Client-side limits on source queries, shared by every reader call. A rate of 0
+ * is unlimited. Schedules override the default rates during a time of day in the
+ * local timezone, e.g. throttle during business hours and run at full speed at
+ * night. A schedule may wrap around midnight (start: "22:00", end: "06:00").
+ */
+type RateLimitConfig struct {
+	QueriesPerSecond float64 `yaml:"queries_per_second"`
+	BytesPerSecond float64 `yaml:"bytes_per_second"`
+	Schedules []RateSchedule `yaml:"schedules"`
+}
+
+type RateSchedule struct {
+	Start string `yaml:"start"`
+	End string `yaml:"end"`
+	QueriesPerSecond float64 `yaml:"queries_per_second"`
+	BytesPerSecond float64 `yaml:"bytes_per_second"`
+}
+
+type RateLimiter struct {
+	config RateLimitConfig
+	mutex sync.Mutex
+	queries *tokenBucket
+	bytes *tokenBucket
+}
+
+/* Token bucket that may go into debt. Callers that take more tokens than are
+ * available sleep until the debt would have been refilled.
+ */
+type tokenBucket struct {
+	rate float64
+	tokens float64
+	last time.Time
+}
+
+func newRateLimiter(config RateLimitConfig) *RateLimiter {
+	now := time.Now()
+	return &RateLimiter{
+		config: config,
+		queries: &tokenBucket{last: now},
+		bytes: &tokenBucket{last: now},
+	}
+}
+
+/* Blocks until another query may be sent. Also waits out any byte debt left by
+ * earlier responses.
+ */
+func (l *RateLimiter) waitQuery() {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	now := time.Now()
+	l.applySchedule(now)
+	wait := l.queries.take(1, now)
+	if byteWait := l.bytes.take(0, now); byteWait > wait {
+		wait = byteWait
+	}
+	l.mutex.Unlock()
+
+	time.Sleep(wait)
+}
+
+/* Charges n bytes of response body against the byte rate. */
+func (l *RateLimiter) consumeBytes(n int) {
+	if l == nil {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	now := time.Now()
+	l.applySchedule(now)
+	l.bytes.take(float64(n), now)
+}
+
+/* Returns the current query and byte rates for status output. */
+func (l *RateLimiter) status() string {
+	if l == nil {
+		return "unlimited"
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.applySchedule(time.Now())
+	return fmt.Sprint(formatRate(l.queries.rate, "queries/s"), ", ", formatRate(l.bytes.rate, "bytes/s"))
+}
+
+func (l *RateLimiter) applySchedule(now time.Time) {
+	queries, bytes := l.config.rates(now)
+	l.queries.setRate(queries, now)
+	l.bytes.setRate(bytes, now)
+}
+
+/* Returns the query and byte rates in effect at t. */
+func (c *RateLimitConfig) rates(t time.Time) (float64, float64) {
+	minute := t.Hour() * 60 + t.Minute()
+	for _, schedule := range c.Schedules {
+		start, err := parseClock(schedule.Start)
+		if err != nil {
+			continue
+		}
+		end, err := parseClock(schedule.End)
+		if err != nil {
+			continue
+		}
+
+		inside := start <= minute && minute < end
+		if end < start { //wraps around midnight
+			inside = minute >= start || minute < end
+		}
+		if inside {
+			return schedule.QueriesPerSecond, schedule.BytesPerSecond
+		}
+	}
+	return c.QueriesPerSecond, c.BytesPerSecond
+}
+
+func (c *RateLimitConfig) validate() error {
+	if c.QueriesPerSecond < 0 || c.BytesPerSecond < 0 {
+		return fmt.Errorf("rate_limit: rates can not be negative")
+	}
+	for _, schedule := range c.Schedules {
+		start, err := parseClock(schedule.Start)
+		if err != nil {
+			return err
+		}
+		end, err := parseClock(schedule.End)
+		if err != nil {
+			return err
+		}
+		if start == end {
+			return fmt.Errorf("rate_limit: schedule %s-%s is empty, use the default rates to limit all day", schedule.Start, schedule.End)
+		}
+		if schedule.QueriesPerSecond < 0 || schedule.BytesPerSecond < 0 {
+			return fmt.Errorf("rate_limit: rates of schedule %s-%s can not be negative", schedule.Start, schedule.End)
+		}
+	}
+	return nil
+}
+
+/* Parses "HH:MM" into minutes after midnight. */
+func parseClock(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, fmt.Errorf("rate_limit: bad time of day %q, expected HH:MM", clock)
+	}
+	return t.Hour() * 60 + t.Minute(), nil
+}
+
+func formatRate(rate float64, unit string) string {
+	if rate <= 0 {
+		return "unlimited " + unit
+	}
+	return fmt.Sprint(rate, " ", unit)
+}
+
+func (b *tokenBucket) setRate(rate float64, now time.Time) {
+	if rate == b.rate {
+		return
+	}
+	b.refill(now)
+	wasUnlimited := b.rate <= 0
+	b.rate = rate
+	if wasUnlimited || b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+/* Takes n tokens and returns how long the caller has to wait for them. */
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.refill(now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		b.last = now
+	}
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+}
+
+/* One second worth of tokens, and at least one. */
+func (b *tokenBucket) burst() float64 {
+	if b.rate < 1 {
+		return 1
+	}
+	return b.rate
+}
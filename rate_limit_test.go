@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testClock(clock string) time.Time {
+	t, _ := time.ParseInLocation("15:04", clock, time.Local)
+	return t
+}
+
+func TestRateLimitSchedules(t *testing.T) {
+	config := RateLimitConfig{
+		QueriesPerSecond: 1,
+		Schedules: []RateSchedule{
+			{Start: "08:00", End: "18:00", QueriesPerSecond: 2},
+			{Start: "22:00", End: "06:00", QueriesPerSecond: 0},
+		},
+	}
+
+	cases := map[string]float64{"12:00": 2, "18:00": 1, "23:30": 0, "05:59": 0, "07:00": 1}
+	for clock, expected := range cases {
+		queries, _ := config.rates(testClock(clock))
+		if queries != expected {
+			t.Fatal("at", clock, "expected", expected, "queries/s but got", queries)
+		}
+	}
+}
+
+func TestRateLimitBadSchedule(t *testing.T) {
+	config := RateLimitConfig{Schedules: []RateSchedule{{Start: "8am", End: "18:00"}}}
+	if config.validate() == nil {
+		t.Fatal("8am should not be accepted")
+	}
+
+	bad := []RateLimitConfig{
+		{QueriesPerSecond: -1},
+		{Schedules: []RateSchedule{{Start: "08:00", End: "08:00", QueriesPerSecond: 5}}},
+		{Schedules: []RateSchedule{{Start: "08:00", End: "18:00", BytesPerSecond: -5}}},
+	}
+	for _, config := range bad {
+		if config.validate() == nil {
+			t.Fatal("config should be rejected:", config)
+		}
+	}
+}
+
+func TestRateLimitQueries(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{QueriesPerSecond: 20})
+
+	start := time.Now()
+	for i := 0; i < 30; i++ {
+		l.waitQuery()
+	}
+	elapsed := time.Since(start)
+	if elapsed < 400*time.Millisecond {
+		t.Fatal("30 queries at 20 queries/s with a burst of 20 took only", elapsed)
+	}
+}
+
+func TestRateLimitBytes(t *testing.T) {
+	l := newRateLimiter(RateLimitConfig{BytesPerSecond: 1000})
+
+	l.waitQuery()
+	l.consumeBytes(1200)
+	start := time.Now()
+	l.waitQuery()
+	if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("byte debt should delay the next query")
+	}
+}
+
+func TestRateLimitUnlimited(t *testing.T) {
+	var l *RateLimiter
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.waitQuery()
+		l.consumeBytes(1 << 20)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatal("a nil limiter should not wait")
+	}
+}
@@ -2,6 +2,8 @@
 The Reader interface is designed so that every method is designed for sequential operation.
 It is up to the calling function to manage any parallelization.
 Reader-implemented objects are designed to read in raw bytes and leave any unmarshalling to Writer-implemented classes.
+Timeseries data is the exception: it is decoded as it streams in and handed over in bounded batches,
+several tuples per slot, each holding its size in the memory budget until the writer calls done().
 Reader methods should be idempotent.
 Updating logMetadata should be handled by the caller.
 */
@@ -16,6 +18,15 @@ type MetadataTuple struct {
 type TimeseriesTuple struct {
 	slot *TimeSlot
 	data []byte
+	readings int64
+	reserved int64
+	budget *MemoryBudget
+}
+
+/* Releases the tuple's share of the memory budget. Called by writers once the data is written. */
+func (t *TimeseriesTuple) done() {
+	t.budget.release(t.reserved)
+	t.reserved = 0
 }
 
 type Reader interface {
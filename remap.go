@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	UUID_MAP_CSV = "dev/uuid_map.csv"
+)
+
+/* New uuids and metadata rewriting for streams moved into another archiver. With a
+ * namespace every uuid is replaced by the version 5 uuid of the old one in that
+ * namespace, so the same source uuid always maps to the same new uuid for a given
+ * destination. The mapping is recorded in the log and written to csv.
+ */
+type RemapConfig struct {
+	Namespace string `yaml:"namespace"`
+	Csv string `yaml:"csv"`
+	Rules []MetadataRule `yaml:"rules"`
+}
+
+/* Rewrites the metadata of records whose fields at the paths in match equal the
+ * given values, or of every record if match is empty. Paths are separated by "/".
+ * Renames apply first, all at once, then replacements, then set and finally
+ * remove. A uuid set by a rule is written as is instead of the namespace uuid.
+ */
+type MetadataRule struct {
+	Match map[string]string `yaml:"match"`
+	Rename map[string]string `yaml:"rename"` //old path: new path
+	Replace []ReplaceRule `yaml:"replace"`
+	Set map[string]string `yaml:"set"`
+	Remove []string `yaml:"remove"`
+}
+
+/* Replaces matches of the regular expression pattern in the string at path. with
+ * may refer to groups as ${1}.
+ */
+type ReplaceRule struct {
+	Path string `yaml:"path"`
+	Pattern string `yaml:"pattern"`
+	With string `yaml:"with"`
+
+	pattern *regexp.Regexp
+}
+
+func defaultRemapConfig() RemapConfig {
+	return RemapConfig{
+		Csv: UUID_MAP_CSV,
+	}
+}
+
+func (c *RemapConfig) enabled() bool {
+	return c.Namespace != "" || len(c.Rules) > 0
+}
+
+func (c *RemapConfig) validate() error {
+	if c.Namespace != "" && !validUuid(c.Namespace) {
+		return fmt.Errorf("remap.namespace must be a uuid")
+	}
+	for i, rule := range c.Rules {
+		for _, replace := range rule.Replace {
+			if _, err := regexp.Compile(replace.Pattern); err != nil {
+				return fmt.Errorf("remap.rules[%d]: bad pattern %q err: %v", i, replace.Pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+/* Whether a rule may set the uuid of a record. */
+func (c *RemapConfig) setsUuid() bool {
+	for _, rule := range c.Rules {
+		paths := make([]string, 0)
+		for _, to := range rule.Rename {
+			paths = append(paths, to)
+		}
+		for path := range rule.Set {
+			paths = append(paths, path)
+		}
+		for _, replace := range rule.Replace {
+			paths = append(paths, replace.Path)
+		}
+		for _, path := range paths {
+			if key, rest := splitMetadataPath(path); key == "uuid" && rest == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* Version 5 (SHA-1, name based) uuid of name in namespace, as in RFC 4122. */
+func uuidV5(namespace string, name string) string {
+	space, _ := hex.DecodeString(strings.Replace(namespace, "-", "", -1))
+	hash := sha1.New()
+	hash.Write(space)
+	hash.Write([]byte(name))
+	sum := hash.Sum(nil)[:16]
+	sum[6] = (sum[6] & 0x0f) | 0x50
+	sum[8] = (sum[8] & 0x3f) | 0x80
+
+	id := hex.EncodeToString(sum)
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
+}
+
+/* Applies the remap rules as the last transform of the pipeline. */
+type Remapper struct {
+	config RemapConfig
+	mutex sync.RWMutex
+	explicit map[string]string //source uuid: uuid set by a rule
+}
+
+func newRemapper(config RemapConfig) (*Remapper, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+	for i := range config.Rules {
+		for j := range config.Rules[i].Replace {
+			replace := &config.Rules[i].Replace[j]
+			replace.pattern = regexp.MustCompile(replace.Pattern)
+		}
+	}
+	return &Remapper{config: config, explicit: make(map[string]string)}, nil
+}
+
+/* The destination uuid of a source uuid. */
+func (r *Remapper) uuid(uuid string) string {
+	if r == nil {
+		return uuid
+	}
+	r.mutex.RLock()
+	mapped, ok := r.explicit[uuid]
+	r.mutex.RUnlock()
+	if ok {
+		return mapped
+	}
+	if r.config.Namespace == "" {
+		return uuid
+	}
+	return uuidV5(r.config.Namespace, strings.ToLower(uuid))
+}
+
+/* Reloads the uuids set by rules in earlier runs from the log, for the timeseries
+ * of streams whose metadata is not migrated again.
+ */
+func (r *Remapper) restore(uuids []string, logger *Logger) {
+	if r == nil || !r.config.setsUuid() {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, uuid := range uuids {
+		mapped := logger.getUuidMapping(uuid)
+		if mapped != "" && mapped != uuid && (r.config.Namespace == "" || mapped != uuidV5(r.config.Namespace, strings.ToLower(uuid))) {
+			r.explicit[uuid] = mapped
+		}
+	}
+}
+
+func (rule *MetadataRule) matches(record *Metadata) bool {
+	return matchesMetadata(record, rule.Match)
+}
+
+/* Whether the fields of record at the paths in match equal the given values. */
+func matchesMetadata(record *Metadata, match map[string]string) bool {
+	for path, expected := range match {
+		value, ok := record.get(path)
+		if !ok || fmt.Sprint(value) != expected {
+			return false
+		}
+	}
+	return true
+}
+
+func (rule *MetadataRule) apply(record *Metadata) error {
+	//renames read every old path before writing any new one, so the order of the
+	//map does not matter, e.g. swapping two fields
+	renamed := make(map[string]interface{})
+	for _, from := range sortedKeys(rule.Rename) {
+		value, ok := record.get(from)
+		if !ok {
+			continue
+		}
+		renamed[from] = value
+		record.remove(from)
+	}
+	for _, from := range sortedKeys(rule.Rename) {
+		value, ok := renamed[from]
+		if !ok {
+			continue
+		}
+		err := record.set(rule.Rename[from], value)
+		if err != nil {
+			return err
+		}
+	}
+	for _, replace := range rule.Replace {
+		value, ok := record.get(replace.Path)
+		text, isString := value.(string)
+		if !ok || !isString {
+			continue
+		}
+		err := record.set(replace.Path, replace.pattern.ReplaceAllString(text, replace.With))
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range sortedKeys(rule.Set) {
+		err := record.set(path, rule.Set[path])
+		if err != nil {
+			return err
+		}
+	}
+	for _, path := range rule.Remove {
+		record.remove(path)
+	}
+	return nil
+}
+
+func (r *Remapper) metadata(record *Metadata) (*Metadata, error) {
+	source := record.Uuid
+	for i := range r.config.Rules {
+		rule := &r.config.Rules[i]
+		if !rule.matches(record) {
+			continue
+		}
+		err := rule.apply(record)
+		if err != nil {
+			return nil, fmt.Errorf("rules[%d]: %v", i, err)
+		}
+	}
+	switch {
+	case record.Uuid == "":
+	case record.Uuid != source:
+		if source != "" {
+			r.mutex.Lock()
+			r.explicit[source] = record.Uuid
+			r.mutex.Unlock()
+		}
+	default:
+		record.Uuid = r.uuid(record.Uuid)
+	}
+	return record, nil
+}
+
+func (r *Remapper) timeseries(data *TimeseriesData) (*TimeseriesData, error) {
+	data.Uuid = r.uuid(data.Uuid)
+	return data, nil
+}
+
+/* Records the new uuid of every uuid in the log and writes the table to the csv. */
+func (r *Remapper) record(uuids []string, logger *Logger) error {
+	sorted := append([]string(nil), uuids...)
+	sort.Strings(sorted)
+
+	var body bytes.Buffer
+	writer := csv.NewWriter(&body)
+	writer.Write([]string{"source_uuid", "destination_uuid"})
+	for _, uuid := range sorted {
+		mapped := r.uuid(uuid)
+		err := logger.updateUuidMapping(uuid, mapped)
+		if err != nil {
+			return err
+		}
+		writer.Write([]string{uuid, mapped})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+
+	os.MkdirAll(getDirPath(r.config.Csv), os.ModePerm)
+	return writeFileAtomic(r.config.Csv, body.Bytes())
+}
+
+/* Keys of m in ascending order. */
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/* Deletes the field at a "/" separated path if it exists. */
+func removeMetadataPath(record map[string]interface{}, path string) {
+	keys := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	var parent interface{} = record
+	if len(keys) > 1 {
+		parent, _ = getMetadataPath(record, strings.Join(keys[:len(keys)-1], "/"))
+	}
+	if object, ok := parent.(map[string]interface{}); ok {
+		delete(object, keys[len(keys)-1])
+	}
+}
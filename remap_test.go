@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUuidV5(t *testing.T) {
+	//python: uuid.uuid5(uuid.NAMESPACE_DNS, "python.org")
+	if id := uuidV5("6ba7b810-9dad-11d1-80b4-00c04fd430c8", "python.org"); id != "886313e1-3b8a-5372-9b90-0c9aee199e5d" {
+		t.Fatal("unexpected v5 uuid:", id)
+	}
+}
+
+func TestRemapRewritesMetadata(t *testing.T) {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	err := pipeline.remap(RemapConfig{
+		Namespace: TEST_QUERY_UUID,
+		Rules: []MetadataRule{
+			{
+				Match: map[string]string{"Metadata/Site": "soda"},
+				Rename: map[string]string{"/Metadata/Building": "Metadata/Location/Building"},
+				Replace: []ReplaceRule{{Path: "/Metadata/SourceName", Pattern: `\s+`, With: "_"}},
+				Set: map[string]string{"Metadata/Site": "Soda Hall"},
+				Remove: []string{"Metadata/Extra"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := makeMetadataTuple([]string{TEST_QUERY_UUID2}, []byte(`[{"uuid":"`+TEST_QUERY_UUID2+`","Metadata":{"Site":"soda","Building":"Soda","SourceName":"Soda  Hall PLC","Extra":1}},{"uuid":"`+TEST_QUERY_UUID+`","Metadata":{"Site":"cory","Extra":1}}]`))
+	transformed, err := pipeline.transformMetadata(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mapped, other := uuidV5(TEST_QUERY_UUID, TEST_QUERY_UUID2), uuidV5(TEST_QUERY_UUID, TEST_QUERY_UUID)
+	expected := `[{"Metadata":{"Location":{"Building":"Soda"},"Site":"Soda Hall","SourceName":"Soda_Hall_PLC"},"uuid":"` + mapped + `"},{"Metadata":{"Extra":1,"Site":"cory"},"uuid":"` + other + `"}]`
+	if string(transformed.data) != expected {
+		t.Fatal("unexpected metadata:", string(transformed.data))
+	}
+
+	ts := makeTimeseriesTuple(&TimeSlot{Uuid: TEST_QUERY_UUID2}, []byte(`[{"uuid":"`+TEST_QUERY_UUID2+`","Readings":[[1,2]]}]`))
+	err = pipeline.transformTimeseries(ts)
+	if err != nil || string(ts.data) != `[{"uuid":"`+mapped+`","Readings":[[1,2]]}]` {
+		t.Fatal("timeseries should carry the new uuid:", string(ts.data), err)
+	}
+}
+
+func TestRemapRecordsMapping(t *testing.T) {
+	testLogStartup()
+	defer testLogTeardown()
+	logger := newTestLog()
+	defer logger.log.Close()
+
+	f, err := ioutil.TempFile("", "uuid_map")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	remapper, err := newRemapper(RemapConfig{Namespace: TEST_QUERY_UUID, Csv: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = remapper.record([]string{TEST_QUERY_UUID2}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapped := uuidV5(TEST_QUERY_UUID, TEST_QUERY_UUID2)
+	if logger.getUuidMapping(TEST_QUERY_UUID2) != mapped {
+		t.Fatal("the mapping should be recorded in the log")
+	}
+	body, _ := ioutil.ReadFile(f.Name())
+	if string(body) != "source_uuid,destination_uuid\n"+TEST_QUERY_UUID2+","+mapped+"\n" {
+		t.Fatal("unexpected csv:", string(body))
+	}
+
+	if (&RemapConfig{Namespace: "soda"}).validate() == nil {
+		t.Fatal("namespaces must be uuids")
+	}
+}
+
+func TestRemapRenamesAtOnce(t *testing.T) {
+	rule := MetadataRule{Rename: map[string]string{"Metadata/A": "Metadata/B", "Metadata/B": "Metadata/C", "Metadata/D": "Metadata/A"}}
+	for i := 0; i < 20; i++ {
+		record := &Metadata{Uuid: TEST_QUERY_UUID, Metadata: map[string]interface{}{"A": "a", "B": "b", "D": "d"}}
+		err := rule.apply(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Metadata["A"] != "d" || record.Metadata["B"] != "a" || record.Metadata["C"] != "b" || len(record.Metadata) != 3 {
+			t.Fatal("each field should move once:", record.Metadata)
+		}
+	}
+}
+
+func TestRemapKeepsUuidSetByRule(t *testing.T) {
+	testLogStartup()
+	defer testLogTeardown()
+	logger := newTestLog()
+	defer logger.log.Close()
+
+	config := RemapConfig{
+		Namespace: TEST_QUERY_UUID,
+		Rules: []MetadataRule{{Match: map[string]string{"uuid": TEST_QUERY_UUID2}, Set: map[string]string{"uuid": "explicit"}}},
+	}
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	err := pipeline.remap(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pipeline.needsMetadata() {
+		t.Fatal("metadata should be migrated before the timeseries it renames")
+	}
+
+	record, err := pipeline.remapper.metadata(&Metadata{Uuid: TEST_QUERY_UUID2})
+	if err != nil || record.Uuid != "explicit" {
+		t.Fatal("the uuid set by the rule should not be mapped again:", record.Uuid, err)
+	}
+	other, _ := pipeline.remapper.metadata(&Metadata{Uuid: TEST_QUERY_UUID})
+	if other.Uuid != uuidV5(TEST_QUERY_UUID, TEST_QUERY_UUID) {
+		t.Fatal("other uuids should be mapped in the namespace:", other.Uuid)
+	}
+	data, _ := pipeline.remapper.timeseries(&TimeseriesData{Uuid: TEST_QUERY_UUID2})
+	if data.Uuid != "explicit" {
+		t.Fatal("timeseries should carry the uuid of their metadata:", data.Uuid)
+	}
+
+	config.Csv = TEST_OUTPUT_DIR + "/uuid_map.csv"
+	defer os.RemoveAll(TEST_OUTPUT_DIR)
+	pipeline.remapper.config.Csv = config.Csv
+	err = pipeline.remapper.record([]string{TEST_QUERY_UUID, TEST_QUERY_UUID2}, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, _ := newRemapper(config)
+	restored.restore([]string{TEST_QUERY_UUID, TEST_QUERY_UUID2}, logger)
+	if restored.uuid(TEST_QUERY_UUID2) != "explicit" || restored.uuid(TEST_QUERY_UUID) != uuidV5(TEST_QUERY_UUID, TEST_QUERY_UUID) {
+		t.Fatal("a later run should restore the uuids set by rules:", restored.explicit)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+/* Controls how QueryClient retries a failed query. Attempts after the first wait
+ * base_backoff, doubling each time up to max_backoff. jitter randomizes each wait
+ * by up to that fraction of it so parallel readers do not retry in lockstep.
+ */
+type RetryPolicy struct {
+	MaxAttempts int `yaml:"max_attempts"`
+	BaseBackoff time.Duration `yaml:"base_backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Jitter float64 `yaml:"jitter"`
+	RetryableStatus []int `yaml:"retryable_status"`
+	RetryNetworkErrors bool `yaml:"retry_network_errors"`
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseBackoff: time.Second,
+		MaxBackoff: 30 * time.Second,
+		Jitter: 0.2,
+		RetryableStatus: []int{408, 429, 500, 502, 503, 504},
+		RetryNetworkErrors: true,
+		RequestTimeout: 30 * time.Second,
+	}
+}
+
+/* Returns how long to wait before retry number retry (1 for the second attempt). */
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	if retry <= 0 || p.BaseBackoff <= 0 {
+		return 0
+	}
+
+	limit := p.MaxBackoff
+	if limit <= 0 {
+		//never reached with a validated config, but doubling must not overflow
+		limit = math.MaxInt64 / 2
+	}
+	d := p.BaseBackoff
+	for i := 1; i < retry && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+
+	if p.Jitter > 0 {
+		spread := float64(d) * p.Jitter
+		d = time.Duration(float64(d) - spread + (2 * spread * rand.Float64()))
+	}
+	return d
+}
+
+func (p *RetryPolicy) retryableStatus(code int) bool {
+	for _, retryable := range p.RetryableStatus {
+		if code == retryable {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
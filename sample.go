@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+const (
+	SAMPLE_EXAMPLES = 5 //mismatches described per sample
+	CONFIDENCE_Z = 1.96 //95% confidence
+)
+
+/* Reads a bounded range of readings straight from the source. */
+type SampleReader interface {
+	readSample(src string, uuid string, start int64, end int64, limit int) ([][]json.RawMessage, error)
+}
+
+/* Comparison of one randomly chosen range of readings. */
+type SampleCheck struct {
+	Uuid string `json:"uuid"`
+	StartTime int64 `json:"start_time"`
+	EndTime int64 `json:"end_time"`
+	Readings int64 `json:"readings"`
+	Matched int64 `json:"matched"`
+	Mismatched int64 `json:"mismatched"` //same written timestamp, different value
+	Missing int64 `json:"missing"`       //in the source but not the destination
+	Extra int64 `json:"extra"`           //in the destination but not the source
+	Examples []string `json:"examples,omitempty"`
+
+	source map[int64][]json.RawMessage //values by written time
+	destination map[int64][]json.RawMessage
+}
+
+/* Result of spot checking readings. ErrorRateUpper is the upper bound of the 95%
+ * Wilson score interval of the fraction of bad readings, i.e. with 95% confidence
+ * no more than this fraction of all migrated readings is wrong.
+ */
+type SampleReport struct {
+	Seed int64 `json:"seed"`
+	Tolerance float64 `json:"tolerance"`
+	Samples int `json:"samples"`
+	Readings int64 `json:"readings"`
+	Matched int64 `json:"matched"`
+	Bad int64 `json:"bad"`
+	ErrorRateUpper float64 `json:"error_rate_upper_95"`
+	Checks []*SampleCheck `json:"checks"`
+}
+
+/* Picks up to n random non-empty slots and a random range of at most limit
+ * readings in each, and fetches those readings from the source. Ranges cover whole
+ * units of the output time format, and source times are rounded down like the
+ * written ones.
+ */
+func (adm *ADMManager) drawSamples(index SlotIndex, n int, limit int, random *rand.Rand) ([]*SampleCheck, error) {
+	sampler, ok := adm.reader.(SampleReader)
+	if !ok {
+		return nil, fmt.Errorf("drawSamples: read mode does not support sampling")
+	}
+
+	var slots []*SlotCheck
+	for _, checks := range index {
+		for _, check := range checks {
+			if check.SourceCount > 0 {
+				slots = append(slots, check)
+			}
+		}
+	}
+	sortSlotChecks(slots)
+	format := adm.chunks.timeFormat()
+
+	var samples []*SampleCheck
+	for _, i := range random.Perm(len(slots)) {
+		if len(samples) == n {
+			break
+		}
+		slot := slots[i]
+		end := slot.EndTime
+		if end == -1 {
+			end = time.Now().UnixNano()
+		}
+
+		start := slot.StartTime
+		if end > start {
+			start += random.Int63n(end - start)
+		}
+		start = truncateTime(start, format)
+		if slot.EndTime != -1 {
+			end = truncateTime(slot.EndTime, format)
+		} else {
+			end = -1
+		}
+		readings, err := sampler.readSample(adm.url, slot.Uuid, start, end, limit)
+		if err == nil && len(readings) == 0 {
+			start = truncateTime(slot.StartTime, format) //sparse slot. sample from its beginning instead.
+			readings, err = sampler.readSample(adm.url, slot.Uuid, start, end, limit)
+		}
+		if err != nil {
+			log.Println("drawSamples: could not sample uuid", slot.Uuid, "err:", err)
+			continue
+		}
+		if len(readings) == 0 {
+			continue
+		}
+
+		sample := &SampleCheck{
+			Uuid: slot.Uuid,
+			StartTime: start,
+			EndTime: end,
+			source: make(map[int64][]json.RawMessage),
+			destination: make(map[int64][]json.RawMessage),
+		}
+		if len(readings) == limit {
+			last, _ := readingTime(readings[len(readings)-1])
+			sample.EndTime = last + 1
+			if timeUnit(format) > 1 && truncateTime(last, format) > start {
+				//the unit of the last reading may hold more than were read
+				sample.EndTime = truncateTime(last, format)
+			}
+		}
+		readings, err = adm.transformSample(slot.Uuid, readings)
+		if err != nil {
+			log.Println("drawSamples: could not transform the sample of uuid", slot.Uuid, "err:", err)
+			continue
+		}
+		for _, reading := range readings {
+			t, err := readingTime(reading)
+			if err != nil || len(reading) < 2 || (sample.EndTime != -1 && t >= sample.EndTime) {
+				continue
+			}
+			written := truncateTime(t, format)
+			sample.source[written] = append(sample.source[written], reading[1])
+		}
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+/* Passes sampled source readings through the transforms, so they compare with
+ * the written readings, e.g. after a unit conversion or a filter.
+ */
+func (adm *ADMManager) transformSample(uuid string, readings [][]json.RawMessage) ([][]json.RawMessage, error) {
+	if adm.pipeline.empty() {
+		return readings, nil
+	}
+	data, err := json.Marshal([]*TimeseriesData{&TimeseriesData{Uuid: uuid, Readings: readings}})
+	if err != nil {
+		return nil, err
+	}
+	tuple := makeTimeseriesTuple(&TimeSlot{Uuid: uuid}, data)
+	err = adm.pipeline.transformTimeseries(tuple)
+	if err != nil {
+		return nil, err
+	}
+
+	var timeseries []*TimeseriesData
+	err = json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return nil, err
+	}
+	var transformed [][]json.RawMessage
+	for _, data := range timeseries {
+		transformed = append(transformed, data.Readings...)
+	}
+	return transformed, nil
+}
+
+/* Samples keyed by uuid. */
+type SampleIndex map[string][]*SampleCheck
+
+func newSampleIndex(samples []*SampleCheck) SampleIndex {
+	index := make(SampleIndex)
+	for _, sample := range samples {
+		index[sample.Uuid] = append(index[sample.Uuid], sample)
+	}
+	return index
+}
+
+/* Like SlotIndex.rekey. */
+func (index SampleIndex) rekey(remapper *Remapper) SampleIndex {
+	if remapper == nil {
+		return index
+	}
+	rekeyed := make(SampleIndex)
+	for uuid, samples := range index {
+		rekeyed[remapper.uuid(uuid)] = samples
+	}
+	return rekeyed
+}
+
+/* Records a destination reading that falls in one of the samples. */
+func (index SampleIndex) collect(uuid string, t int64, reading []json.RawMessage) {
+	for _, sample := range index[uuid] {
+		if t >= sample.StartTime && (sample.EndTime == -1 || t < sample.EndTime) && len(reading) > 1 {
+			sample.destination[t] = append(sample.destination[t], reading[1])
+		}
+	}
+}
+
+/* Compares the source and destination readings of every sample. Values match if
+ * they are byte-for-byte equal or, with a positive tolerance, numbers at most
+ * tolerance apart. Readings written with the same time are matched in any order.
+ */
+func compareSamples(samples []*SampleCheck, tolerance float64, seed int64) *SampleReport {
+	report := &SampleReport{
+		Seed: seed,
+		Tolerance: tolerance,
+		Samples: len(samples),
+		Checks: samples,
+	}
+
+	for _, sample := range samples {
+		for t, values := range sample.source {
+			others := sample.destination[t]
+			used := make([]bool, len(others))
+			var unmatched []json.RawMessage
+			for _, value := range values {
+				sample.Readings++
+				j := matchValue(value, others, used, tolerance)
+				if j < 0 {
+					unmatched = append(unmatched, value)
+					continue
+				}
+				used[j] = true
+				sample.Matched++
+			}
+			for _, value := range unmatched {
+				j := matchValue(nil, others, used, -1)
+				if j < 0 {
+					sample.Missing++
+					sample.example(fmt.Sprint("missing ", t))
+					continue
+				}
+				used[j] = true
+				sample.Mismatched++
+				sample.example(fmt.Sprint("at ", t, " source ", string(value), " destination ", string(others[j])))
+			}
+			for j := range others {
+				if !used[j] {
+					sample.Extra++
+					sample.example(fmt.Sprint("extra ", t))
+				}
+			}
+		}
+		for t, others := range sample.destination {
+			if _, ok := sample.source[t]; !ok {
+				sample.Extra += int64(len(others))
+				sample.example(fmt.Sprint("extra ", t))
+			}
+		}
+
+		report.Readings += sample.Readings + sample.Extra
+		report.Matched += sample.Matched
+		report.Bad += sample.Mismatched + sample.Missing + sample.Extra
+	}
+
+	report.ErrorRateUpper = wilsonUpper(report.Bad, report.Readings)
+	return report
+}
+
+func (s *SampleCheck) example(description string) {
+	if len(s.Examples) < SAMPLE_EXAMPLES {
+		s.Examples = append(s.Examples, description)
+	}
+}
+
+/* Index of the first unused value in others matching value, or -1. A negative
+ * tolerance takes any unused value.
+ */
+func matchValue(value json.RawMessage, others []json.RawMessage, used []bool, tolerance float64) int {
+	for j, other := range others {
+		if !used[j] && (tolerance < 0 || valuesMatch(value, other, tolerance)) {
+			return j
+		}
+	}
+	return -1
+}
+
+func valuesMatch(a json.RawMessage, b json.RawMessage, tolerance float64) bool {
+	if bytes.Equal(a, b) {
+		return true
+	}
+	if tolerance <= 0 {
+		return false
+	}
+	x, errA := strconv.ParseFloat(string(a), 64)
+	y, errB := strconv.ParseFloat(string(b), 64)
+	return errA == nil && errB == nil && math.Abs(x-y) <= tolerance
+}
+
+/* Upper bound of the Wilson score interval of bad out of n at 95% confidence. */
+func wilsonUpper(bad int64, n int64) float64 {
+	if n == 0 {
+		return 1
+	}
+	z := CONFIDENCE_Z
+	p := float64(bad) / float64(n)
+	total := float64(n)
+	center := p + z*z/(2*total)
+	margin := z * math.Sqrt(p*(1-p)/total+z*z/(4*total*total))
+	return math.Min(1, (center+margin)/(1+z*z/total))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+)
+
+func TestSampleCompare(t *testing.T) {
+	sample := &SampleCheck{
+		Uuid: "a",
+		StartTime: 0,
+		EndTime: 100,
+		source: map[int64][]json.RawMessage{1: {json.RawMessage("1.5")}, 2: {json.RawMessage("2")}, 3: {json.RawMessage("3")}},
+		destination: make(map[int64][]json.RawMessage),
+	}
+	samples := newSampleIndex([]*SampleCheck{sample})
+	samples.collect("a", 1, []json.RawMessage{json.RawMessage("1"), json.RawMessage("1.5")})
+	samples.collect("a", 2, []json.RawMessage{json.RawMessage("2"), json.RawMessage("2.0000001")})
+	samples.collect("a", 4, []json.RawMessage{json.RawMessage("4"), json.RawMessage("4")})
+	samples.collect("a", 200, []json.RawMessage{json.RawMessage("200"), json.RawMessage("4")})
+
+	report := compareSamples([]*SampleCheck{sample}, 0, 1)
+	if sample.Matched != 1 || sample.Mismatched != 1 || sample.Missing != 1 || sample.Extra != 1 || report.Bad != 3 {
+		t.Fatal("unexpected comparison:", sample.Matched, sample.Mismatched, sample.Missing, sample.Extra, report.Bad)
+	}
+
+	sample.Matched, sample.Mismatched, sample.Missing, sample.Extra = 0, 0, 0, 0
+	sample.Readings = 0
+	compareSamples([]*SampleCheck{sample}, 0.001, 1)
+	if sample.Matched != 2 {
+		t.Fatal("values within the tolerance should match")
+	}
+}
+
+func TestSampleCompareTruncatedTimes(t *testing.T) {
+	uuid := "0f2c5a1e-9a7b-4c3d-8e6f-112233445566"
+	server, _ := newTestServer([]int{200}, `[{"uuid": "`+uuid+`", "Readings": [[2000100, 1], [2000200, 2], [2000900, 3]]}]`)
+	defer server.Close()
+
+	adm := &ADMManager{
+		url: server.URL,
+		reader: newGilesReader(newTestQueryClient(), defaultGilesConfig(), nil),
+		chunks: &ChunkFiles{config: OutputConfig{TimeFormat: TF_MS}},
+	}
+	index := newSlotIndex([]*Window{&Window{Uuid: uuid, Readings: [][]int64{{2000000, 3}, {3000000, 0}}}})
+	samples, err := adm.drawSamples(index, 1, 10, rand.New(rand.NewSource(1)))
+	if err != nil || len(samples) != 1 {
+		t.Fatal("expected one sample:", samples, err)
+	}
+	if len(samples[0].source[2000000]) != 3 || samples[0].StartTime != 2000000 {
+		t.Fatal("source times should be rounded down to ms:", samples[0].source, samples[0].StartTime)
+	}
+
+	sampleIndex := newSampleIndex(samples)
+	for _, reading := range [][]json.RawMessage{{json.RawMessage("2"), json.RawMessage("2")}, {json.RawMessage("2"), json.RawMessage("1")}, {json.RawMessage("2"), json.RawMessage("3")}} {
+		sampleIndex.collect(uuid, truncateTime(mustReadingTime(t, reading)*1000000, TF_MS), reading)
+	}
+	compareSamples(samples, 0, 1)
+	if samples[0].Matched != 3 || samples[0].Mismatched != 0 || samples[0].Missing != 0 || samples[0].Extra != 0 {
+		t.Fatal("readings written in the same ms should match in any order:", samples[0].Matched, samples[0].Examples)
+	}
+}
+
+func mustReadingTime(t *testing.T, reading []json.RawMessage) int64 {
+	ms, err := readingTime(reading)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ms
+}
+
+func TestSampleConfidence(t *testing.T) {
+	upper := wilsonUpper(0, 1000)
+	if upper <= 0 || upper > 0.004 {
+		t.Fatal("no bad readings in 1000 should bound the error rate near 0.4% but got", upper)
+	}
+	if wilsonUpper(500, 1000) < 0.5 || wilsonUpper(0, 0) != 1 {
+		t.Fatal("unexpected bounds")
+	}
+}
+
+func TestSampleDraw(t *testing.T) {
+	uuid := "0f2c5a1e-9a7b-4c3d-8e6f-112233445566"
+	server, calls := newTestServer([]int{200}, `[{"uuid": "`+uuid+`", "Readings": [[5, 1.25], [6, 1.5]]}]`)
+	defer server.Close()
+
+	adm := &ADMManager{
+		url: server.URL,
+		reader: newGilesReader(newTestQueryClient(), defaultGilesConfig(), nil),
+	}
+	index := newSlotIndex([]*Window{&Window{Uuid: uuid, Readings: [][]int64{{0, 2}, {10, 0}}}})
+	samples, err := adm.drawSamples(index, 5, 2, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) != 1 || *calls != 1 {
+		t.Fatal("only the non-empty slot should be sampled but got", len(samples), "samples in", *calls, "queries")
+	}
+	if len(samples[0].source[6]) != 1 || string(samples[0].source[6][0]) != "1.5" || samples[0].EndTime != 7 {
+		t.Fatal("unexpected sample:", samples[0].source, samples[0].EndTime)
+	}
+}
+
+func TestSampleDrawConvertsUnits(t *testing.T) {
+	uuid := "0f2c5a1e-9a7b-4c3d-8e6f-112233445566"
+	server, _ := newTestServer([]int{200}, `[{"uuid": "`+uuid+`", "Readings": [[5, 1.5]]}]`)
+	defer server.Close()
+
+	pipeline := newTestPipeline(t, "transforms:\n  - type: units\n")
+	record := &Metadata{Uuid: uuid}
+	record.set("Properties/UnitofMeasure", "kW")
+	pipeline.index.observe(record)
+	adm := &ADMManager{
+		url: server.URL,
+		reader: newGilesReader(newTestQueryClient(), defaultGilesConfig(), nil),
+		pipeline: pipeline,
+	}
+	index := newSlotIndex([]*Window{&Window{Uuid: uuid, Readings: [][]int64{{0, 1}}}})
+	samples, err := adm.drawSamples(index, 1, 10, rand.New(rand.NewSource(1)))
+	if err != nil || len(samples) != 1 {
+		t.Fatal("expected one sample:", samples, err)
+	}
+	if len(samples[0].source[5]) != 1 || string(samples[0].source[5][0]) != "1500" {
+		t.Fatal("sampled readings should be converted like the written ones:", samples[0].source)
+	}
+}
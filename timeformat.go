@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/* Formats of the timestamps written to the destination */
+const (
+	TF_NS = "ns"
+	TF_US = "us"
+	TF_MS = "ms"
+	TF_S = "s"
+	TF_RFC3339 = "rfc3339"
+)
+
+/* Nanoseconds per unit of the integer formats */
+var timeUnits = map[string]int64{
+	TF_NS: 1,
+	TF_US: int64(time.Microsecond),
+	TF_MS: int64(time.Millisecond),
+	TF_S: int64(time.Second),
+}
+
+func validTimeFormat(format string) bool {
+	_, ok := timeUnits[format]
+	return ok || format == TF_RFC3339
+}
+
+/* Rounds t / unit down, also for times before 1970. */
+func floorDiv(t int64, unit int64) int64 {
+	q := t / unit
+	if t%unit != 0 && t < 0 {
+		q--
+	}
+	return q
+}
+
+/* Nanoseconds the timestamps written in format are rounded down to. 1 for ns and
+ * rfc3339, which are exact.
+ */
+func timeUnit(format string) int64 {
+	unit, ok := timeUnits[format]
+	if !ok {
+		return 1
+	}
+	return unit
+}
+
+/* The nanosecond time t is read back as once written in format. */
+func truncateTime(t int64, format string) int64 {
+	unit := timeUnit(format)
+	return floorDiv(t, unit) * unit
+}
+
+/* Rewrites the nanosecond timestamps of readings in the configured output format
+ * as the last step of the pipeline, after deduplication and downsampling, which
+ * work on nanoseconds. rfc3339 timestamps are strings with nanoseconds in the
+ * timezone of the stream's Properties/Timezone, or the configured timezone for
+ * streams without a known one.
+ */
+type TimeFormatter struct {
+	format string
+	location *time.Location
+	index *MetadataIndex
+	remapper *Remapper
+
+	mutex sync.Mutex
+	locations map[string]*time.Location //nil for unknown timezones
+	sources map[string]string //destination to source uuids when remapping
+}
+
+func newTimeFormatter(config OutputConfig, index *MetadataIndex, remapper *Remapper) (*TimeFormatter, error) {
+	if !validTimeFormat(config.TimeFormat) {
+		return nil, fmt.Errorf("output.time_format must be one of ns, us, ms, s and rfc3339")
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("output.timezone: %v", err)
+	}
+	f := &TimeFormatter{
+		format: config.TimeFormat,
+		location: location,
+		index: index,
+		remapper: remapper,
+		locations: make(map[string]*time.Location),
+	}
+	if f.format == TF_RFC3339 {
+		index.require()
+	}
+	return f, nil
+}
+
+/* Location of the readings of uuid, which may be a destination uuid. */
+func (f *TimeFormatter) streamLocation(uuid string) *time.Location {
+	record, ok := f.index.lookup(uuid)
+	if !ok && f.remapper != nil {
+		f.mutex.Lock()
+		if f.sources == nil {
+			//metadata is complete before timeseries are read when the index is required
+			f.sources = make(map[string]string)
+			f.index.mutex.RLock()
+			for source := range f.index.records {
+				f.sources[f.remapper.uuid(source)] = source
+			}
+			f.index.mutex.RUnlock()
+		}
+		source, found := f.sources[uuid]
+		f.mutex.Unlock()
+		if found {
+			record, ok = f.index.lookup(source)
+		}
+	}
+	if !ok || record.Properties == nil || record.Properties.Timezone == "" {
+		return f.location
+	}
+
+	name := record.Properties.Timezone
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	location, seen := f.locations[name]
+	if !seen {
+		var err error
+		location, err = time.LoadLocation(name)
+		if err != nil {
+			log.Println("timeFormatter: unknown timezone", name, "of uuid", uuid, "using", f.location)
+			location = nil
+		}
+		f.locations[name] = location
+	}
+	if location == nil {
+		return f.location
+	}
+	return location
+}
+
+func (f *TimeFormatter) formatTime(t int64, location *time.Location) json.RawMessage {
+	if f.format == TF_RFC3339 {
+		return json.RawMessage(strconv.Quote(time.Unix(0, t).In(location).Format(time.RFC3339Nano)))
+	}
+	return json.RawMessage(strconv.FormatInt(floorDiv(t, timeUnits[f.format]), 10))
+}
+
+/* Rewrites the timestamps of the tuple in place. */
+func (f *TimeFormatter) formatTuple(tuple *TimeseriesTuple) error {
+	var timeseries []*TimeseriesData
+	err := json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return err
+	}
+
+	for _, data := range timeseries {
+		location := f.location
+		if f.format == TF_RFC3339 {
+			location = f.streamLocation(data.Uuid)
+		}
+		for _, reading := range data.Readings {
+			t, err := readingTime(reading)
+			if err != nil {
+				return err
+			}
+			reading[0] = f.formatTime(t, location)
+		}
+	}
+
+	tuple.data, err = json.Marshal(timeseries)
+	return err
+}
+
+/* Parses a timestamp written in format back into nanoseconds. Integer formats
+ * coarser than ns give the start of the unit.
+ */
+func parseOutputTime(raw json.RawMessage, format string) (int64, error) {
+	if format == TF_RFC3339 {
+		var text string
+		err := json.Unmarshal(raw, &text)
+		if err != nil {
+			return 0, fmt.Errorf("bad timestamp %s", string(raw))
+		}
+		t, err := time.Parse(time.RFC3339Nano, text)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	}
+
+	unit, ok := timeUnits[format]
+	if !ok {
+		unit = 1
+	}
+	t, err := parseTimestamp(string(raw))
+	if err != nil {
+		return 0, err
+	}
+	return t * unit, nil
+}
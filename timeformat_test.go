@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseTimestampExact(t *testing.T) {
+	cases := map[string]int64{
+		"1500000000000000001": 1500000000000000001,
+		"1.500000000000000001e18": 1500000000000000001,
+		"1500000000000000001.9": 1500000000000000001,
+		"-5": -5,
+	}
+	for raw, expected := range cases {
+		if parsed, err := parseTimestamp(raw); err != nil || parsed != expected {
+			t.Fatal("expected", expected, "for", raw, "but got", parsed, err)
+		}
+	}
+	for _, raw := range []string{"1e19", "abc", `"1"`} {
+		if _, err := parseTimestamp(raw); err == nil {
+			t.Fatal("timestamp should be rejected:", raw)
+		}
+	}
+}
+
+func TestWindowTimesExact(t *testing.T) {
+	var windows []*Window
+	err := json.Unmarshal([]byte(`[{"uuid":"a","Readings":[[1500000000000000001,3,1.5,2.25,3],[1500000000000000003,1.0,0,0,0]]}]`), &windows)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slots := windows[0].getTimeSlots()
+	if len(slots) != 2 || slots[0].StartTime != 1500000000000000001 || slots[0].EndTime != 1500000000000000003 || slots[0].Count != 3 || slots[1].Count != 1 {
+		t.Fatal("unexpected slots:", slots[0], slots[1])
+	}
+
+	if json.Unmarshal([]byte(`[{"uuid":"a","Readings":[[1]]}]`), &windows) == nil {
+		t.Fatal("a window without a count should be rejected")
+	}
+}
+
+func TestTimeFormats(t *testing.T) {
+	index := newMetadataIndex()
+	record := &Metadata{Uuid: "a"}
+	record.set("Properties/Timezone", "America/Los_Angeles")
+	index.observe(record)
+
+	cases := map[string]string{
+		TF_NS: `[{"uuid":"a","Readings":[[1500000000123456789,1]]},{"uuid":"b","Readings":[[1500000000123456789,1]]}]`,
+		TF_MS: `[{"uuid":"a","Readings":[[1500000000123,1]]},{"uuid":"b","Readings":[[1500000000123,1]]}]`,
+		TF_RFC3339: `[{"uuid":"a","Readings":[["2017-07-13T19:40:00.123456789-07:00",1]]},{"uuid":"b","Readings":[["2017-07-14T11:40:00.123456789+09:00",1]]}]`,
+	}
+	for format, expected := range cases {
+		pipeline := &Pipeline{index: index}
+		err := pipeline.formatTimes(OutputConfig{TimeFormat: format, Timezone: "Asia/Tokyo"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tuple := makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[1500000000123456789,1]]},{"uuid":"b","Readings":[[1500000000123456789,1]]}]`))
+		tuple.readings = 2
+		written := runTestTimeseries(pipeline, tuple)
+		if len(written) != 1 || written[0] != expected {
+			t.Fatal("unexpected", format, "output:", written)
+		}
+
+		var timeseries []*TimeseriesData
+		json.Unmarshal([]byte(written[0]), &timeseries)
+		parsed, err := parseOutputTime(timeseries[1].Readings[0][0], format)
+		if err != nil || (format != TF_MS && parsed != 1500000000123456789) || (format == TF_MS && parsed != 1500000000123000000) {
+			t.Fatal("unexpected", format, "time read back:", parsed, err)
+		}
+	}
+
+	if (&Pipeline{index: index}).formatTimes(OutputConfig{TimeFormat: "fortnights"}) == nil {
+		t.Fatal("unknown formats should be rejected")
+	}
+}
+
+func TestTimeFormatRemappedUuids(t *testing.T) {
+	source := "0f2c5a1e-9a7b-4c3d-8e6f-112233445566"
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	err := pipeline.remap(RemapConfig{Namespace: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &Metadata{Uuid: source}
+	record.set("Properties/Timezone", "America/Los_Angeles")
+	pipeline.index.observe(record)
+	err = pipeline.formatTimes(OutputConfig{TimeFormat: TF_RFC3339})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := makeTimeseriesTuple(&TimeSlot{Uuid: source}, []byte(`[{"uuid":"`+source+`","Readings":[[0,1]]}]`))
+	tuple.readings = 1
+	written := runTestTimeseries(pipeline, tuple)
+	expected := `[{"uuid":"` + pipeline.remapper.uuid(source) + `","Readings":[["1969-12-31T16:00:00-08:00",1]]}]`
+	if len(written) != 1 || written[0] != expected {
+		t.Fatal("the stream's timezone should apply to its new uuid:", written)
+	}
+}
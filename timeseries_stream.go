@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+var errUnexpectedToken = errors.New("decodeTimeseriesStream: unexpected token")
+
+/* Decodes a Giles timeseries response of the form
+ * [{"uuid": "...", "Readings": [[time, value], ...]}, ...]
+ * reading by reading, calling emit with batches of at most batchReadings readings
+ * or roughly batchBytes bytes so the whole response is never held in memory.
+ * defaultUuid is used for streams whose readings precede their uuid.
+ */
+func decodeTimeseriesStream(body io.Reader, defaultUuid string, batchReadings int, batchBytes int, emit func(uuid string, readings [][]json.RawMessage) error) error {
+	dec := json.NewDecoder(body)
+	err := expectDelim(dec, '[')
+	if err != nil {
+		return err
+	}
+
+	for dec.More() {
+		err = expectDelim(dec, '{')
+		if err != nil {
+			return err
+		}
+
+		uuid := ""
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+
+			switch strings.ToLower(key) {
+			case "uuid":
+				err = dec.Decode(&uuid)
+				if err != nil {
+					return err
+				}
+			case "readings":
+				if uuid == "" {
+					uuid = defaultUuid
+				}
+				err = decodeReadings(dec, uuid, batchReadings, batchBytes, emit)
+				if err != nil {
+					return err
+				}
+			default:
+				var skipped json.RawMessage
+				err = dec.Decode(&skipped)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = expectDelim(dec, '}')
+		if err != nil {
+			return err
+		}
+	}
+
+	return expectDelim(dec, ']')
+}
+
+func decodeReadings(dec *json.Decoder, uuid string, batchReadings int, batchBytes int, emit func(string, [][]json.RawMessage) error) error {
+	err := expectDelim(dec, '[')
+	if err != nil {
+		return err
+	}
+
+	batch := make([][]json.RawMessage, 0)
+	size := 0
+	for dec.More() {
+		var reading []json.RawMessage
+		err = dec.Decode(&reading)
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, reading)
+		for _, field := range reading {
+			size += len(field) + 1
+		}
+
+		if (batchReadings > 0 && len(batch) >= batchReadings) || (batchBytes > 0 && size >= batchBytes) {
+			err = emit(uuid, batch)
+			if err != nil {
+				return err
+			}
+			batch = make([][]json.RawMessage, 0)
+			size = 0
+		}
+	}
+
+	if len(batch) > 0 {
+		err = emit(uuid, batch)
+		if err != nil {
+			return err
+		}
+	}
+	return expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("%w: expected %v but got %v", errUnexpectedToken, delim, token)
+	}
+	return nil
+}
+
+/* Returns the timestamp of a [time, value] reading in the unit it was queried in. */
+func readingTime(reading []json.RawMessage) (int64, error) {
+	if len(reading) == 0 {
+		return 0, fmt.Errorf("readingTime: empty reading")
+	}
+
+	t, err := parseTimestamp(string(reading[0]))
+	if err != nil {
+		return 0, fmt.Errorf("readingTime: %v", err)
+	}
+	return t, nil
+}
+
+/* Parses an integer timestamp exactly. Archivers may write large timestamps with
+ * a fraction or an exponent, e.g. 1.4e18, which are parsed without going through
+ * float64 so no precision is lost above 2^53. Fractions are truncated.
+ */
+func parseTimestamp(raw string) (int64, error) {
+	t, err := strconv.ParseInt(raw, 10, 64)
+	if err == nil {
+		return t, nil
+	}
+
+	f, _, err := big.ParseFloat(raw, 10, 128, big.ToZero)
+	if err != nil || f.IsInf() {
+		return 0, fmt.Errorf("bad timestamp %s", raw)
+	}
+	i, _ := f.Int(nil)
+	if !i.IsInt64() {
+		return 0, fmt.Errorf("timestamp %s out of range", raw)
+	}
+	return i.Int64(), nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func testStreamBody(uuid string, n int) string {
+	readings := make([]string, n)
+	for i := 0; i < n; i++ {
+		readings[i] = "[" + strings.Repeat("1", 19) + ", 2.5]"
+	}
+	return `[{"uuid": "` + uuid + `", "Properties": {"UnitofMeasure": "F"}, "Readings": [` + strings.Join(readings, ",") + `]}]`
+}
+
+func TestStreamBatches(t *testing.T) {
+	var batches []int
+	err := decodeTimeseriesStream(strings.NewReader(testStreamBody("a", 25)), "", 10, 0, func(uuid string, readings [][]json.RawMessage) error {
+		if uuid != "a" {
+			t.Fatal("expected uuid a but got", uuid)
+		}
+		batches = append(batches, len(readings))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(batches) != 3 || batches[0] != 10 || batches[2] != 5 {
+		t.Fatal("expected batches of 10, 10 and 5 but got", batches)
+	}
+}
+
+func TestStreamBatchBytes(t *testing.T) {
+	count := 0
+	err := decodeTimeseriesStream(strings.NewReader(testStreamBody("a", 20)), "", 0, 100, func(uuid string, readings [][]json.RawMessage) error {
+		count++
+		if len(readings) > 5 {
+			t.Fatal("batch of", len(readings), "readings exceeds the byte bound")
+		}
+		return nil
+	})
+	if err != nil || count < 4 {
+		t.Fatal("expected at least 4 batches but got", count, err)
+	}
+}
+
+func TestStreamKeepsPrecision(t *testing.T) {
+	body := `[{"Readings": [[1497891600123456789, 70.25]], "uuid": "b"}]`
+	err := decodeTimeseriesStream(strings.NewReader(body), "default", 10, 0, func(uuid string, readings [][]json.RawMessage) error {
+		if uuid != "default" {
+			t.Fatal("readings before the uuid should use the default uuid but got", uuid)
+		}
+		if string(readings[0][0]) != "1497891600123456789" {
+			t.Fatal("timestamp lost precision:", string(readings[0][0]))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamRejectsErrorPayload(t *testing.T) {
+	err := decodeTimeseriesStream(strings.NewReader(`{"error": "bad query"}`), "a", 10, 0, func(string, [][]json.RawMessage) error {
+		return nil
+	})
+	if err == nil {
+		t.Fatal("an error object is not a timeseries response")
+	}
+}
+
+func TestPagedReadKeepsReadingsAtPageBoundary(t *testing.T) {
+	uuid := "174fb37a-5a5f-57a8-bc60-14746cb4656f"
+	stored := [][2]int64{{1, 1}, {2, 1}, {2, 2}, {2, 3}, {2, 4}, {3, 1}, {4, 1}}
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		queries = append(queries, string(body))
+		var start, end, limit int64
+		fmt.Sscanf(strings.Split(string(body), " in (")[1], "%dns, %dns) limit %d", &start, &end, &limit)
+		readings := make([]string, 0)
+		for _, reading := range stored {
+			if reading[0] >= start && reading[0] < end && int64(len(readings)) < limit {
+				readings = append(readings, fmt.Sprintf("[%d,%d]", reading[0], reading[1]))
+			}
+		}
+		w.Write([]byte(`[{"uuid":"` + uuid + `","Readings":[` + strings.Join(readings, ",") + `]}]`))
+	}))
+	defer server.Close()
+
+	config := defaultGilesConfig()
+	config.PageSize = 2
+	reader := newGilesReader(newTestQueryClient(), config, nil)
+	dataChan := make(chan *TimeseriesTuple, 100)
+	err := reader.readSlotPaged(server.URL, &TimeSlot{Uuid: uuid, StartTime: 0, EndTime: 10}, dataChan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(dataChan)
+
+	var read []string
+	for tuple := range dataChan {
+		var timeseries []*TimeseriesData
+		json.Unmarshal(tuple.data, &timeseries)
+		for _, reading := range timeseries[0].Readings {
+			read = append(read, string(reading[0])+":"+string(reading[1]))
+		}
+	}
+	if strings.Join(read, " ") != "1:1 2:1 2:2 2:3 2:4 3:1 4:1" {
+		t.Fatal("expected every reading once but got", read, "from", queries)
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+/* A transform in the transforms list of params.yml. Every key other than type is
+ * an option of the transform, e.g. {type: filter, exclude: [...]}.
+ */
+type TransformConfig struct {
+	Type string `yaml:"type"`
+	Options map[string]interface{} `yaml:",inline"`
+}
+
+/* Modifies data between the reader and the writer. Returning nil drops the record
+ * or timeseries.
+ */
+type Transformer interface {
+	metadata(record *Metadata) (*Metadata, error)
+	timeseries(data *TimeseriesData) (*TimeseriesData, error)
+}
+
+/* Builds a transformer from its options. Transforms that act on the metadata of a
+ * uuid keep index and call its require method.
+ */
+type TransformFactory func(options map[string]interface{}, index *MetadataIndex) (Transformer, error)
+
+var transformRegistry = make(map[string]TransformFactory)
+
+/* Makes a transform available under name in params.yml. Called from init functions. */
+func registerTransform(name string, factory TransformFactory) {
+	transformRegistry[name] = factory
+}
+
+func init() {
+	registerTransform("filter", newFilterTransform)
+	registerTransform("annotate", newAnnotateTransform)
+	registerTransform("units", newUnitsTransform)
+}
+
+/* Decodes options into the struct pointed to by v, rejecting unknown options. */
+func decodeOptions(options map[string]interface{}, v interface{}) error {
+	body, err := yaml.Marshal(options)
+	if err != nil {
+		return err
+	}
+	return yaml.UnmarshalStrict(body, v)
+}
+
+/* The configured chain of transformers, applied in order. */
+type Pipeline struct {
+	names []string
+	transformers []Transformer
+	index *MetadataIndex
+	downsampler *Downsampler
+	deduplicator *Deduplicator
+	remapper *Remapper
+	analyzer *QualityAnalyzer
+	formatter *TimeFormatter
+}
+
+func newPipeline(configs []TransformConfig) (*Pipeline, error) {
+	pipeline := &Pipeline{index: newMetadataIndex()}
+	for i, config := range configs {
+		factory, ok := transformRegistry[config.Type]
+		if !ok {
+			return nil, fmt.Errorf("transforms[%d]: unknown type %q, known types are %s", i, config.Type, strings.Join(transformTypes(), ", "))
+		}
+		transformer, err := factory(config.Options, pipeline.index)
+		if err != nil {
+			return nil, fmt.Errorf("transforms[%d] (%s): %v", i, config.Type, err)
+		}
+		pipeline.names = append(pipeline.names, config.Type)
+		pipeline.transformers = append(pipeline.transformers, transformer)
+	}
+	return pipeline, nil
+}
+
+func transformTypes() []string {
+	var types []string
+	for name := range transformRegistry {
+		types = append(types, name)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func (p *Pipeline) empty() bool {
+	return p == nil || len(p.transformers) == 0
+}
+
+/* Aggregates readings after the transforms and notes the resolution in the metadata. */
+func (p *Pipeline) downsample(config DownsampleConfig) error {
+	downsampler, err := newDownsampler(config)
+	if err != nil {
+		return err
+	}
+	p.names = append(p.names, "downsample")
+	p.transformers = append(p.transformers, downsampler)
+	p.downsampler = downsampler
+	return nil
+}
+
+/* Drops repeated readings before the transforms. */
+func (p *Pipeline) deduplicate() {
+	p.deduplicator = newDeduplicator()
+}
+
+/* The configured uuid remapping, or nil. */
+func (p *Pipeline) uuidRemapper() *Remapper {
+	if p == nil {
+		return nil
+	}
+	return p.remapper
+}
+
+/* Rewrites metadata and uuids after the transforms. */
+func (p *Pipeline) remap(config RemapConfig) error {
+	remapper, err := newRemapper(config)
+	if err != nil {
+		return err
+	}
+	if config.setsUuid() {
+		//timeseries carry the uuid the rules set in their stream's metadata
+		p.index.require()
+	}
+	p.names = append(p.names, "remap")
+	p.transformers = append(p.transformers, remapper)
+	p.remapper = remapper
+	return nil
+}
+
+/* Whether timeseries pass through the pipeline even without transforms. */
+func (p *Pipeline) deduplicates() bool {
+	return p != nil && p.deduplicator != nil
+}
+
+/* Analyzes the quality of readings as read from the source, before the transforms. */
+func (p *Pipeline) analyze(config QualityConfig) error {
+	analyzer, err := newQualityAnalyzer(config, p.index)
+	if err != nil {
+		return err
+	}
+	p.analyzer = analyzer
+	return nil
+}
+
+/* Writes timestamps in the output time format. Added last, after any remapping. */
+func (p *Pipeline) formatTimes(config OutputConfig) error {
+	if config.exactTimes() {
+		return nil
+	}
+	formatter, err := newTimeFormatter(config, p.index, p.remapper)
+	if err != nil {
+		return err
+	}
+	p.formatter = formatter
+	return nil
+}
+
+/* Whether timeseries pass through the pipeline for steps other than the transforms. */
+func (p *Pipeline) passesTimeseries() bool {
+	return p != nil && (p.deduplicator != nil || p.analyzer != nil || p.formatter != nil)
+}
+
+/* The data quality analysis, or nil. */
+func (p *Pipeline) qualityAnalyzer() *QualityAnalyzer {
+	if p == nil {
+		return nil
+	}
+	return p.analyzer
+}
+
+/* Whether a transform needs the metadata of every uuid before its timeseries. */
+func (p *Pipeline) needsMetadata() bool {
+	return p != nil && p.index.needed()
+}
+
+/* Transforms metadata tuples from in and sends them to out, closing out when in is
+ * closed. Tuples that fail to transform are dropped and their uuids returned as failed.
+ */
+func (p *Pipeline) runMetadata(in chan *MetadataTuple, out chan *MetadataTuple) *ProcessError {
+	defer close(out)
+	failed := make([]interface{}, 0)
+	for tuple := range in {
+		transformed, err := p.transformMetadata(tuple)
+		if err != nil {
+			log.Println("runMetadata: could not transform uuids:", tuple.uuids, "err:", err)
+			for _, uuid := range tuple.uuids {
+				failed = append(failed, newFailedItem(uuid, err))
+			}
+			continue
+		}
+		if transformed != nil {
+			out <- transformed
+		}
+	}
+
+	if len(failed) > 0 {
+		return newProcessError(fmt.Sprint("runMetadata: could not transform uuids:", failed), false, failed)
+	}
+	return nil
+}
+
+/* Transforms timeseries tuples from in and sends them to out, closing out when in
+ * is closed. Tuples that fail to transform are dropped and their slots returned as failed.
+ */
+func (p *Pipeline) runTimeseries(in chan *TimeseriesTuple, out chan *TimeseriesTuple) *ProcessError {
+	defer close(out)
+	var check *QualityCheck
+	if p.analyzer != nil {
+		check = p.analyzer.start()
+		defer check.finish()
+	}
+	var dedup *Dedup
+	if p.deduplicator != nil {
+		dedup = p.deduplicator.start()
+	}
+	var aggregation *Aggregation
+	if p.downsampler != nil {
+		aggregation = p.downsampler.start()
+	}
+
+	failed := make([]interface{}, 0)
+	send := func(tuple *TimeseriesTuple) {
+		if p.formatter != nil {
+			err := p.formatter.formatTuple(tuple)
+			if err != nil {
+				log.Println("runTimeseries: could not format timestamps of uuid:", tuple.slot.Uuid, "err:", err)
+				tuple.done()
+				failed = append(failed, newFailedItem(tuple.slot, err))
+				return
+			}
+		}
+		out <- tuple
+	}
+
+	for tuple := range in {
+		var err error
+		if check != nil {
+			err = check.add(tuple)
+		}
+		if err == nil && dedup != nil {
+			err = dedup.add(tuple)
+		}
+		if err == nil && len(p.transformers) > 0 {
+			err = p.transformTimeseries(tuple)
+		}
+		var flushed []*TimeseriesTuple
+		if err == nil && aggregation != nil {
+			flushed, err = aggregation.add(tuple)
+		}
+		if err != nil {
+			log.Println("runTimeseries: could not transform uuid:", tuple.slot.Uuid, "err:", err)
+			tuple.done()
+			failed = append(failed, newFailedItem(tuple.slot, err))
+			continue
+		}
+		for _, closed := range flushed {
+			send(closed)
+		}
+		if tuple.readings == 0 {
+			tuple.done()
+			continue
+		}
+		send(tuple)
+	}
+
+	if aggregation != nil {
+		flushed, err := aggregation.flush(nil)
+		if err != nil {
+			log.Println("runTimeseries: could not close buckets err:", err)
+		}
+		for _, closed := range flushed {
+			send(closed)
+		}
+	}
+
+	if len(failed) > 0 {
+		return newProcessError(fmt.Sprint("runTimeseries: could not transform slots:", failed), false, failed)
+	}
+	return nil
+}
+
+/* Returns the transformed tuple, or nil if every record was dropped. */
+func (p *Pipeline) transformMetadata(tuple *MetadataTuple) (*MetadataTuple, error) {
+	var records []*Metadata
+	err := json.Unmarshal(tuple.data, &records)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept []*Metadata
+	for _, record := range records {
+		if p.index.needed() {
+			//the transformers change record in place. the index keeps it as read.
+			observed, err := record.clone()
+			if err != nil {
+				return nil, err
+			}
+			p.index.observe(observed)
+		}
+		for i, transformer := range p.transformers {
+			record, err = transformer.metadata(record)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", p.names[i], err)
+			}
+			if record == nil {
+				break
+			}
+		}
+		if record != nil {
+			kept = append(kept, record)
+		}
+	}
+
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	data, err := json.Marshal(kept)
+	if err != nil {
+		return nil, err
+	}
+	return makeMetadataTuple(tuple.uuids, data), nil
+}
+
+/* Transforms the tuple in place. A tuple left with no readings should be dropped. */
+func (p *Pipeline) transformTimeseries(tuple *TimeseriesTuple) error {
+	var timeseries []*TimeseriesData
+	err := json.Unmarshal(tuple.data, &timeseries)
+	if err != nil {
+		return err
+	}
+
+	var kept []*TimeseriesData
+	readings := 0
+	for _, data := range timeseries {
+		for i, transformer := range p.transformers {
+			data, err = transformer.timeseries(data)
+			if err != nil {
+				return fmt.Errorf("%s: %v", p.names[i], err)
+			}
+			if data == nil {
+				break
+			}
+		}
+		if data != nil && len(data.Readings) > 0 {
+			kept = append(kept, data)
+			readings += len(data.Readings)
+		}
+	}
+
+	tuple.data, err = json.Marshal(kept)
+	if err != nil {
+		return err
+	}
+	tuple.readings = int64(readings)
+	return nil
+}
+
+/* Drops uuids and readings. include and exclude list uuids, start and end bound
+ * reading timestamps to [start, end), and drop_null drops readings without a value.
+ */
+type FilterTransform struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	Start int64 `yaml:"start"`
+	End int64 `yaml:"end"`
+	DropNull bool `yaml:"drop_null"`
+
+	include map[string]bool
+	exclude map[string]bool
+}
+
+func newFilterTransform(options map[string]interface{}, index *MetadataIndex) (Transformer, error) {
+	f := &FilterTransform{}
+	err := decodeOptions(options, f)
+	if err != nil {
+		return nil, err
+	}
+	if f.End != 0 && f.End <= f.Start {
+		return nil, fmt.Errorf("end must be after start")
+	}
+
+	f.include = make(map[string]bool)
+	for _, uuid := range f.Include {
+		f.include[uuid] = true
+	}
+	f.exclude = make(map[string]bool)
+	for _, uuid := range f.Exclude {
+		f.exclude[uuid] = true
+	}
+	return f, nil
+}
+
+func (f *FilterTransform) keep(uuid string) bool {
+	return (len(f.include) == 0 || f.include[uuid]) && !f.exclude[uuid]
+}
+
+func (f *FilterTransform) metadata(record *Metadata) (*Metadata, error) {
+	if !f.keep(record.Uuid) {
+		return nil, nil
+	}
+	return record, nil
+}
+
+func (f *FilterTransform) timeseries(data *TimeseriesData) (*TimeseriesData, error) {
+	if !f.keep(data.Uuid) {
+		return nil, nil
+	}
+	if f.Start == 0 && f.End == 0 && !f.DropNull {
+		return data, nil
+	}
+
+	readings := data.Readings[:0]
+	for _, reading := range data.Readings {
+		t, err := readingTime(reading)
+		if err != nil {
+			return nil, err
+		}
+		if t < f.Start || (f.End != 0 && t >= f.End) {
+			continue
+		}
+		if f.DropNull && (len(reading) < 2 || string(reading[1]) == "null") {
+			continue
+		}
+		readings = append(readings, reading)
+	}
+	data.Readings = readings
+	return data, nil
+}
+
+/* Sets metadata fields. Keys are paths separated by "/", e.g. Metadata/Migration/Tool. */
+type AnnotateTransform struct {
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+func newAnnotateTransform(options map[string]interface{}, index *MetadataIndex) (Transformer, error) {
+	a := &AnnotateTransform{}
+	err := decodeOptions(options, a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AnnotateTransform) metadata(record *Metadata) (*Metadata, error) {
+	for path, value := range a.Metadata {
+		err := record.set(path, value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func (a *AnnotateTransform) timeseries(data *TimeseriesData) (*TimeseriesData, error) {
+	return data, nil
+}
+
+/* Sets the field at a "/" separated path, creating objects along the way. A leading
+ * "/" is ignored.
+ */
+func setMetadataPath(record map[string]interface{}, path string, value interface{}) error {
+	keys := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	current := record
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := current[key]
+		if !ok {
+			child := make(map[string]interface{})
+			current[key] = child
+			current = child
+			continue
+		}
+		child, ok := next.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: %s is not an object", path, key)
+		}
+		current = child
+	}
+	current[keys[len(keys)-1]] = value
+	return nil
+}
+
+/* Looks up the field at a "/" separated path. */
+func getMetadataPath(record map[string]interface{}, path string) (interface{}, bool) {
+	var current interface{} = record
+	for _, key := range strings.Split(strings.TrimPrefix(path, "/"), "/") {
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		current, ok = object[key]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
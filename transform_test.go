@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestPipeline(t *testing.T, yml string) *Pipeline {
+	testConfigStartup(yml)
+	defer testConfigTeardown()
+
+	c, err := newAdmConfig([]string{"-config", TEST_CONFIG})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pipeline, err := newPipeline(c.Transforms)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pipeline
+}
+
+func TestTransformTimeseries(t *testing.T) {
+	pipeline := newTestPipeline(t, "transforms:\n  - type: filter\n    exclude: [b]\n    start: 2\n    drop_null: true\n")
+
+	tuple := makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[1,1.5],[2,null],[3,1234567890.123456789]]},{"uuid":"b","Readings":[[5,1]]}]`))
+	err := pipeline.transformTimeseries(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tuple.data) != `[{"uuid":"a","Readings":[[3,1234567890.123456789]]}]` || tuple.readings != 1 {
+		t.Fatal("unexpected transformed data:", string(tuple.data), tuple.readings)
+	}
+}
+
+func TestTransformMetadata(t *testing.T) {
+	pipeline := newTestPipeline(t, "transforms:\n  - type: filter\n    include: [a]\n  - type: annotate\n    metadata:\n      Metadata/Migration/Tool: adm\n")
+
+	tuple := makeMetadataTuple([]string{"a", "b"}, []byte(`[{"uuid":"a","Metadata":{"Site":"soda"},"Properties":{"ReadingType":"double"}},{"uuid":"b"}]`))
+	transformed, err := pipeline.transformMetadata(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"Metadata":{"Migration":{"Tool":"adm"},"Site":"soda"},"Properties":{"ReadingType":"double"},"uuid":"a"}]`
+	if string(transformed.data) != expected {
+		t.Fatal("unexpected transformed metadata:", string(transformed.data))
+	}
+
+	tuple = makeMetadataTuple([]string{"b"}, []byte(`[{"uuid":"b"}]`))
+	transformed, err = pipeline.transformMetadata(tuple)
+	if err != nil || transformed != nil {
+		t.Fatal("tuples with every record dropped should be skipped")
+	}
+}
+
+func TestTransformConfigErrors(t *testing.T) {
+	_, err := newPipeline([]TransformConfig{{Type: "nope"}})
+	if err == nil || !strings.Contains(err.Error(), "filter") {
+		t.Fatal("unknown types should be rejected with the known types listed:", err)
+	}
+
+	_, err = newPipeline([]TransformConfig{{Type: "filter", Options: map[string]interface{}{"exclud": []string{"a"}}}})
+	if err == nil {
+		t.Fatal("misspelled options should be rejected")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	UNIT_FIELD = "Properties/UnitofMeasure"
+	SOURCE_UNIT_FIELD = "Properties/SourceUnitofMeasure" //unit before conversion, kept to resume runs
+)
+
+/* Converts a value x in one unit to (x + Offset) * Scale / Divisor in To. */
+type UnitConversion struct {
+	To string `yaml:"to"`
+	Offset float64 `yaml:"offset"`
+	Scale float64 `yaml:"scale"`
+	Divisor float64 `yaml:"divisor"`
+}
+
+func (c UnitConversion) apply(x float64) float64 {
+	return (x + c.Offset) * c.Scale / c.Divisor
+}
+
+func (c UnitConversion) identity() bool {
+	return c.Offset == 0 && c.Scale == c.Divisor
+}
+
+func scaleTo(to string, scale float64) UnitConversion {
+	return UnitConversion{To: to, Scale: scale, Divisor: 1}
+}
+
+func same(unit string) UnitConversion {
+	return scaleTo(unit, 1)
+}
+
+/* Built-in conversions of each unit system, keyed by the unit names found in
+ * sMAP streams. Temperatures are converted to degrees Celsius.
+ */
+var unitSystems = map[string]map[string]UnitConversion{
+	"si": {
+		"C": same("C"),
+		"°C": same("C"),
+		"degC": same("C"),
+		"Celsius": same("C"),
+		"F": {To: "C", Offset: -32, Scale: 5, Divisor: 9},
+		"°F": {To: "C", Offset: -32, Scale: 5, Divisor: 9},
+		"degF": {To: "C", Offset: -32, Scale: 5, Divisor: 9},
+		"Fahrenheit": {To: "C", Offset: -32, Scale: 5, Divisor: 9},
+		"K": {To: "C", Offset: -273.15, Scale: 1, Divisor: 1},
+
+		"W": same("W"),
+		"kW": scaleTo("W", 1e3),
+		"MW": scaleTo("W", 1e6),
+		"BTU/h": scaleTo("W", 0.29307107017),
+		"BTU/hr": scaleTo("W", 0.29307107017),
+		"kBTU/h": scaleTo("W", 293.07107017),
+		"ton": scaleTo("W", 3516.8528421),
+		"tons": scaleTo("W", 3516.8528421),
+		"hp": scaleTo("W", 745.69987158),
+
+		"J": same("J"),
+		"kJ": scaleTo("J", 1e3),
+		"Wh": scaleTo("J", 3600),
+		"kWh": scaleTo("J", 3.6e6),
+		"MWh": scaleTo("J", 3.6e9),
+		"BTU": scaleTo("J", 1055.05585262),
+		"kBTU": scaleTo("J", 1055055.85262),
+		"therm": scaleTo("J", 105505585.262),
+
+		"Pa": same("Pa"),
+		"kPa": scaleTo("Pa", 1e3),
+		"psi": scaleTo("Pa", 6894.757293),
+		"inH2O": scaleTo("Pa", 249.08891),
+		"inHg": scaleTo("Pa", 3386.389),
+
+		"m": same("m"),
+		"ft": scaleTo("m", 0.3048),
+		"in": scaleTo("m", 0.0254),
+		"m/s": same("m/s"),
+		"mph": scaleTo("m/s", 0.44704),
+		"fpm": scaleTo("m/s", 0.00508),
+		"ft/min": scaleTo("m/s", 0.00508),
+
+		"m3": same("m3"),
+		"gal": scaleTo("m3", 0.003785411784),
+		"ft3": scaleTo("m3", 0.028316846592),
+		"m3/s": same("m3/s"),
+		"gpm": scaleTo("m3/s", 0.003785411784/60),
+		"GPM": scaleTo("m3/s", 0.003785411784/60),
+		"cfm": scaleTo("m3/s", 0.028316846592/60),
+		"CFM": scaleTo("m3/s", 0.028316846592/60),
+
+		"V": same("V"),
+		"A": same("A"),
+		"Hz": same("Hz"),
+		"s": same("s"),
+		"%": same("%"),
+		"%RH": same("%RH"),
+		"ppm": same("ppm"),
+	},
+}
+
+/* Converts readings to a unit system according to the unit in each uuid's
+ * metadata, and rewrites the unit in the metadata. Readings of uuids with unknown
+ * units are left as they are. units adds to or overrides the built-in table.
+ */
+type UnitsTransform struct {
+	System string `yaml:"system"`
+	Units map[string]UnitConversion `yaml:"units"`
+
+	table map[string]UnitConversion
+	index *MetadataIndex
+	mutex sync.Mutex
+	logged map[string]bool
+}
+
+func newUnitsTransform(options map[string]interface{}, index *MetadataIndex) (Transformer, error) {
+	u := &UnitsTransform{System: "si"}
+	err := decodeOptions(options, u)
+	if err != nil {
+		return nil, err
+	}
+	builtin, ok := unitSystems[u.System]
+	if !ok {
+		return nil, fmt.Errorf("unknown unit system %q", u.System)
+	}
+
+	u.table = make(map[string]UnitConversion)
+	for unit, conversion := range builtin {
+		u.table[unit] = conversion
+	}
+	for unit, conversion := range u.Units {
+		if conversion.To == "" {
+			return nil, fmt.Errorf("units: %s has no target unit", unit)
+		}
+		if conversion.Scale == 0 {
+			conversion.Scale = 1
+		}
+		if conversion.Divisor == 0 {
+			conversion.Divisor = 1
+		}
+		u.table[unit] = conversion
+	}
+
+	u.index = index
+	u.logged = make(map[string]bool)
+	index.require()
+	return u, nil
+}
+
+/* Unit of a record as read from the source. */
+func sourceUnit(record *Metadata) (string, bool) {
+	for _, path := range []string{SOURCE_UNIT_FIELD, UNIT_FIELD} {
+		if value, ok := record.get(path); ok {
+			unit, ok := value.(string)
+			return strings.TrimSpace(unit), ok
+		}
+	}
+	return "", false
+}
+
+/* Logs a problem with a uuid once. */
+func (u *UnitsTransform) warn(uuid string, message string) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	if u.logged[uuid] {
+		return
+	}
+	u.logged[uuid] = true
+	log.Println("units:", message, "uuid:", uuid)
+}
+
+func (u *UnitsTransform) conversion(record *Metadata) (UnitConversion, bool) {
+	uuid := record.Uuid
+	unit, ok := sourceUnit(record)
+	if !ok {
+		u.warn(uuid, "no unit, readings left unconverted.")
+		return UnitConversion{}, false
+	}
+	conversion, ok := u.table[unit]
+	if !ok {
+		u.warn(uuid, fmt.Sprintf("unknown unit %q, readings left unconverted.", unit))
+		return UnitConversion{}, false
+	}
+	return conversion, true
+}
+
+func (u *UnitsTransform) metadata(record *Metadata) (*Metadata, error) {
+	conversion, ok := u.conversion(record)
+	if !ok || conversion.identity() {
+		return record, nil
+	}
+	unit, _ := sourceUnit(record)
+	err := record.set(SOURCE_UNIT_FIELD, unit)
+	if err != nil {
+		return nil, err
+	}
+	record.Properties.UnitofMeasure = conversion.To
+	record.Properties.ReadingType = RT_DOUBLE //converted readings are written as floats
+	return record, nil
+}
+
+func (u *UnitsTransform) timeseries(data *TimeseriesData) (*TimeseriesData, error) {
+	record, ok := u.index.lookup(data.Uuid)
+	if !ok {
+		u.warn(data.Uuid, "no metadata, readings left unconverted.")
+		return data, nil
+	}
+	conversion, ok := u.conversion(record)
+	if !ok || conversion.identity() {
+		return data, nil
+	}
+
+	for _, reading := range data.Readings {
+		if len(reading) < 2 || string(reading[1]) == "null" {
+			continue
+		}
+		value, err := strconv.ParseFloat(string(reading[1]), 64)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s of uuid %s is not a number", string(reading[1]), data.Uuid)
+		}
+		reading[1] = json.RawMessage(strconv.FormatFloat(conversion.apply(value), 'f', -1, 64))
+	}
+	return data, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestUnitsConvertsReadings(t *testing.T) {
+	pipeline := newTestPipeline(t, "transforms:\n  - type: units\n    units:\n      furlong: {to: m, scale: 201.168}\n")
+	if !pipeline.needsMetadata() {
+		t.Fatal("the units transform needs metadata before timeseries")
+	}
+
+	tuple := makeMetadataTuple([]string{"a", "b", "c"}, []byte(`[{"uuid":"a","Properties":{"UnitofMeasure":"F","ReadingType":"long"}},{"uuid":"b","Properties":{"UnitofMeasure":"furlong"}},{"uuid":"c","Properties":{"UnitofMeasure":"smoots"}}]`))
+	transformed, err := pipeline.transformMetadata(tuple)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `[{"Properties":{"ReadingType":"double","SourceUnitofMeasure":"F","UnitofMeasure":"C"},"uuid":"a"},{"Properties":{"ReadingType":"double","SourceUnitofMeasure":"furlong","UnitofMeasure":"m"},"uuid":"b"},{"Properties":{"UnitofMeasure":"smoots"},"uuid":"c"}]`
+	if string(transformed.data) != expected {
+		t.Fatal("unexpected transformed metadata:", string(transformed.data))
+	}
+
+	ts := makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[1,212],[2,null],[3,-40]]},{"uuid":"b","Readings":[[1,2]]},{"uuid":"c","Readings":[[1,7]]},{"uuid":"d","Readings":[[1,7]]}]`))
+	err = pipeline.transformTimeseries(ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `[{"uuid":"a","Readings":[[1,100],[2,null],[3,-40]]},{"uuid":"b","Readings":[[1,402.336]]},{"uuid":"c","Readings":[[1,7]]},{"uuid":"d","Readings":[[1,7]]}]`
+	if string(ts.data) != expected {
+		t.Fatal("unexpected converted readings:", string(ts.data))
+	}
+}
+
+func TestUnitsLoadsWrittenMetadata(t *testing.T) {
+	f, err := ioutil.TempFile("", "metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[[{"uuid":"a","Properties":{"SourceUnitofMeasure":"kW","UnitofMeasure":"W"}}],[{"uuid":"b"}]]`)
+	f.Close()
+
+	pipeline := newTestPipeline(t, "transforms:\n  - type: units\n")
+	err = pipeline.index.load(f.Name())
+	if err != nil || pipeline.index.size() != 2 {
+		t.Fatal("could not load metadata:", err)
+	}
+
+	ts := makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[1,1.5]]}]`))
+	err = pipeline.transformTimeseries(ts)
+	if err != nil || string(ts.data) != `[{"uuid":"a","Readings":[[1,1500]]}]` {
+		t.Fatal("readings should be converted from the unit read from the source:", string(ts.data), err)
+	}
+
+	_, err = newPipeline([]TransformConfig{{Type: "units", Options: map[string]interface{}{"system": "cubits"}}})
+	if err == nil {
+		t.Fatal("unknown unit systems should be rejected")
+	}
+}
+
+func TestUnitsIndexKeepsSourceMetadata(t *testing.T) {
+	pipeline := newTestPipeline(t, "transforms:\n  - type: units\n")
+	err := pipeline.remap(RemapConfig{Rules: []MetadataRule{{Remove: []string{SOURCE_UNIT_FIELD}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := makeMetadataTuple([]string{"a"}, []byte(`[{"uuid":"a","Properties":{"UnitofMeasure":"kW"}}]`))
+	transformed, err := pipeline.transformMetadata(tuple)
+	if err != nil || string(transformed.data) != `[{"Properties":{"ReadingType":"double","UnitofMeasure":"W"},"uuid":"a"}]` {
+		t.Fatal("unexpected transformed metadata:", string(transformed.data), err)
+	}
+
+	ts := makeTimeseriesTuple(&TimeSlot{Uuid: "a"}, []byte(`[{"uuid":"a","Readings":[[1,1.5]]}]`))
+	err = pipeline.transformTimeseries(ts)
+	if err != nil || string(ts.data) != `[{"uuid":"a","Readings":[[1,1500]]}]` {
+		t.Fatal("rules applied to the written metadata should not change the conversion:", string(ts.data), err)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+)
+
+const (
+	VERIFY_REPORT = "dev/verify_report.json"
+)
+
+/* Outcomes of verifying a slot */
+const (
+	VS_OK = "ok"
+	VS_MISSING = "missing"       //gap: the source has readings but the destination has none
+	VS_SHORT = "short"           //fewer readings in the destination than in the source
+	VS_EXTRA = "extra"           //more readings in the destination than in the source
+	VS_DUPLICATES = "duplicates" //readings written more than once
+)
+
+/* Source and destination reading counts of one slot. */
+type SlotCheck struct {
+	Uuid string `json:"uuid"`
+	StartTime int64 `json:"start_time"`
+	EndTime int64 `json:"end_time"`
+	SourceCount int64 `json:"source_count"`
+	DestinationCount int64 `json:"destination_count"`
+	Duplicates int64 `json:"duplicates"`
+	Status string `json:"status"`
+
+	last int64
+	seen bool
+}
+
+type VerifyReport struct {
+	Slots int `json:"slots"`
+	Ok int `json:"ok"`
+	Unmatched int64 `json:"unmatched_readings"` //destination readings outside every source slot
+	Unreadable []string `json:"unreadable_files"`
+	Requeued int `json:"requeued"`
+	Problems []*SlotCheck `json:"problems"`
+	Sample *SampleReport `json:"sample,omitempty"`
+}
+
+type VerifyOptions struct {
+	requeue bool
+	samples int //slots to spot check. 0 only compares counts.
+	sampleReadings int
+	tolerance float64
+	seed int64
+}
+
+/* Slots of each uuid sorted by start time. */
+type SlotIndex map[string][]*SlotCheck
+
+func newSlotIndex(windows []*Window) SlotIndex {
+	index := make(SlotIndex)
+	for _, window := range windows {
+		for _, slot := range window.getTimeSlots() {
+			index[slot.Uuid] = append(index[slot.Uuid], &SlotCheck{
+				Uuid: slot.Uuid,
+				StartTime: slot.StartTime,
+				EndTime: slot.EndTime,
+				SourceCount: slot.Count,
+			})
+		}
+	}
+	for _, checks := range index {
+		sort.Slice(checks, func(i, j int) bool {
+			return checks[i].StartTime < checks[j].StartTime
+		})
+	}
+	return index
+}
+
+/* Keys the index by the uuids written to the destination. The checks keep their source uuids. */
+func (index SlotIndex) rekey(remapper *Remapper) SlotIndex {
+	if remapper == nil {
+		return index
+	}
+	rekeyed := make(SlotIndex)
+	for uuid, checks := range index {
+		rekeyed[remapper.uuid(uuid)] = checks
+	}
+	return rekeyed
+}
+
+/* Returns the slot of uuid containing time t written in format, or nil. Slot
+ * boundaries are rounded down like the written times, so a reading in the same
+ * unit as the end of a slot not falling on a unit boundary is found in the next.
+ */
+func (index SlotIndex) find(uuid string, t int64, format string) *SlotCheck {
+	checks := index[uuid]
+	i := sort.Search(len(checks), func(i int) bool {
+		return truncateTime(checks[i].StartTime, format) > t
+	}) - 1
+	if i < 0 || (checks[i].EndTime != -1 && t >= truncateTime(checks[i].EndTime, format)) {
+		return nil
+	}
+	return checks[i]
+}
+
+/* Counts a destination reading. Slots are written in ascending time order, so a
+ * reading that is not after the previous one of its slot was written before.
+ */
+func (index SlotIndex) count(uuid string, t int64, format string, report *VerifyReport) {
+	check := index.find(uuid, t, format)
+	if check == nil {
+		report.Unmatched++
+		return
+	}
+	if timeUnit(format) > 1 {
+		//distinct readings within one unit are written with the same time
+		check.DestinationCount++
+		return
+	}
+	if check.seen && t <= check.last {
+		check.Duplicates++
+		return
+	}
+	check.DestinationCount++
+	check.last = t
+	check.seen = true
+}
+
+/* Classifies every slot and collects the ones that do not match. */
+func (index SlotIndex) finish(report *VerifyReport) {
+	for _, checks := range index {
+		for _, check := range checks {
+			report.Slots++
+			switch {
+			case check.DestinationCount == 0 && check.SourceCount > 0:
+				check.Status = VS_MISSING
+			case check.DestinationCount < check.SourceCount:
+				check.Status = VS_SHORT
+			case check.DestinationCount > check.SourceCount:
+				check.Status = VS_EXTRA
+			case check.Duplicates > 0:
+				check.Status = VS_DUPLICATES
+			default:
+				check.Status = VS_OK
+				report.Ok++
+				continue
+			}
+			report.Problems = append(report.Problems, check)
+		}
+	}
+	sortSlotChecks(report.Problems)
+}
+
+func sortSlotChecks(checks []*SlotCheck) {
+	sort.Slice(checks, func(i, j int) bool {
+		a, b := checks[i], checks[j]
+		return a.Uuid < b.Uuid || (a.Uuid == b.Uuid && a.StartTime < b.StartTime)
+	})
+}
+
+/* Counts the readings in a timeseries file written by the FileWriter and collects
+ * the ones falling in samples.
+ */
+func countFileReadings(path string, format string, index SlotIndex, report *VerifyReport, samples SampleIndex) error {
+	return scanTimeseriesFile(path, format, func(uuid string, t int64, reading []json.RawMessage) error {
+		index.count(uuid, t, format, report)
+		samples.collect(uuid, t, reading)
+		return nil
+	})
+}
+
+/* Calls visit with every reading in a timeseries file written by the FileWriter:
+ * a json array of batches, each an array of {"uuid", "Readings"} objects. t is the
+ * reading's timestamp, written in format, in nanoseconds.
+ */
+func scanTimeseriesFile(path string, format string, visit func(uuid string, t int64, reading []json.RawMessage) error) error {
+	f, err := openDecompressed(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		_, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for decoder.More() {
+			var batch []*TimeseriesData
+			err = decoder.Decode(&batch)
+			if err != nil {
+				return err
+			}
+			for _, data := range batch {
+				for _, reading := range data.Readings {
+					if len(reading) == 0 {
+						return fmt.Errorf("empty reading of uuid %s", data.Uuid)
+					}
+					t, err := parseOutputTime(reading[0], format)
+					if err != nil {
+						return err
+					}
+					err = visit(data.Uuid, t, reading)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		_, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+/* Marks the slots of problems as not started so the next run migrates them again. */
+func (adm *ADMManager) requeue(problems []*SlotCheck) int {
+	wanted := make(map[slotKey]bool)
+	for _, check := range problems {
+		wanted[slotKey{check.Uuid, check.StartTime, check.EndTime}] = true
+	}
+
+	requeued := 0
+	for _, slot := range adm.log.getUuidTimeseriesKeySet() {
+		if wanted[slotKey{slot.Uuid, slot.StartTime, slot.EndTime}] {
+			adm.log.updateUuidTimeseriesStatus(slot, NOT_STARTED)
+			requeued++
+		}
+	}
+	if requeued > 0 {
+		adm.log.updateLogMetadata(TIMESERIES_WRITTEN, NOT_STARTED)
+	}
+	return requeued
+}
+
+/* Compares the reading count of every slot in the source against the destination
+ * and spot checks the values of a sample of readings.
+ */
+func (adm *ADMManager) verify(options VerifyOptions) (*VerifyReport, error) {
+	if adm.writeMode != WM_FILE {
+		return nil, fmt.Errorf("verify: only file write mode can be verified")
+	}
+	if adm.config != nil && adm.config.Downsample.enabled() {
+		//requeueing every slot as short would migrate everything again
+		return nil, fmt.Errorf("verify: the destination holds downsampled buckets, which can not be compared with the source readings")
+	}
+
+	adm.processUuids()
+	adm.pipeline.uuidRemapper().restore(adm.uuids, adm.log)
+	if options.samples > 0 {
+		adm.loadMetadataIndex() //for transforms of the sampled readings
+	}
+	windows, err := adm.reader.readWindows(adm.url, adm.uuids)
+	if err != nil {
+		if err.Fatal() {
+			return nil, err
+		}
+		log.Println("verify: some windows could not be read err:", err)
+	}
+
+	index := newSlotIndex(windows).rekey(adm.pipeline.uuidRemapper())
+	var samples []*SampleCheck
+	if options.samples > 0 {
+		var sampleErr error
+		samples, sampleErr = adm.drawSamples(index, options.samples, options.sampleReadings, rand.New(rand.NewSource(options.seed)))
+		if sampleErr != nil {
+			return nil, sampleErr
+		}
+	}
+
+	sampleIndex := newSampleIndex(samples).rekey(adm.pipeline.uuidRemapper())
+	report := &VerifyReport{}
+	for _, chunk := range adm.chunks.manifest.Chunks {
+		fmt.Println("verify: counting", chunk.File)
+		countErr := countFileReadings(chunk.File, chunk.TimeFormat, index, report, sampleIndex)
+		if countErr != nil {
+			log.Println("verify: could not read", chunk.File, "err:", countErr)
+			report.Unreadable = append(report.Unreadable, chunk.File)
+		}
+	}
+	index.finish(report)
+	if options.samples > 0 {
+		report.Sample = compareSamples(samples, options.tolerance, options.seed)
+	}
+
+	if options.requeue {
+		report.Requeued = adm.requeue(report.Problems)
+	}
+	return report, nil
+}
+
+/* Entry point of `adm verify`. */
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	options := VerifyOptions{}
+	fs.BoolVar(&options.requeue, "requeue", false, "mark mismatched slots for re-migration on the next run")
+	fs.IntVar(&options.samples, "sample", 0, "number of random slots whose readings are compared value by value")
+	fs.IntVar(&options.sampleReadings, "sample_readings", 1000, "readings compared per sampled slot")
+	fs.Float64Var(&options.tolerance, "tolerance", 0, "largest difference between numeric values considered equal. 0 compares bytes")
+	fs.Int64Var(&options.seed, "seed", time.Now().UnixNano(), "seed of the sample, to repeat a verification")
+	reportPath := fs.String("report", VERIFY_REPORT, "where to write the json report")
+	config, err := newAdmConfigWithFlags(fs, args)
+	if err != nil {
+		return err
+	}
+	err = config.validate()
+	if err != nil {
+		return err
+	}
+
+	adm, err := newADMManager(config)
+	if err != nil {
+		return err
+	}
+
+	report, err := adm.verify(options)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(getDirPath(*reportPath), os.ModePerm)
+	err = writeFileAtomic(*reportPath, body)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("verify:", report.Ok, "of", report.Slots, "slots match,", len(report.Problems), "do not,",
+		report.Unmatched, "readings outside any slot,", len(report.Unreadable), "unreadable files,", report.Requeued, "requeued")
+	for _, check := range report.Problems {
+		fmt.Println(" ", check.Status, check.Uuid, check.StartTime, check.EndTime, "source:", check.SourceCount, "destination:", check.DestinationCount, "duplicates:", check.Duplicates)
+	}
+	if report.Sample != nil {
+		fmt.Println("verify: sampled", report.Sample.Readings, "readings in", report.Sample.Samples, "slots,", report.Sample.Bad,
+			"bad. with 95% confidence at most", report.Sample.ErrorRateUpper, "of readings are wrong. seed:", report.Sample.Seed)
+	}
+	fmt.Println("verify: report written to", *reportPath)
+	return nil
+}
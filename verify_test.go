@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const (
+	TEST_VERIFY_FILE = "test_verify.json"
+)
+
+func newTestSlotIndex() SlotIndex {
+	return newSlotIndex([]*Window{
+		&Window{Uuid: "a", Readings: [][]int64{{0, 2}, {10, 3}, {20, 1}}},
+		&Window{Uuid: "b", Readings: [][]int64{{0, 1}}},
+	})
+}
+
+func TestVerifyFindsSlots(t *testing.T) {
+	index := newTestSlotIndex()
+	if check := index.find("a", 15, ""); check == nil || check.StartTime != 10 || check.EndTime != 20 {
+		t.Fatal("expected slot [10, 20) but got", check)
+	}
+	if check := index.find("a", 1000, ""); check == nil || check.EndTime != -1 {
+		t.Fatal("the last slot should be open ended but got", check)
+	}
+	if index.find("a", -1, "") != nil || index.find("c", 5, "") != nil {
+		t.Fatal("readings outside every slot should not match")
+	}
+}
+
+func TestVerifyCountsFile(t *testing.T) {
+	defer os.Remove(TEST_VERIFY_FILE)
+	body := `[[{"uuid":"a","Readings":[[1,1.5],[2,1.5]]}],[{"uuid":"a","Readings":[[10,1],[11,1],[11,2]]}],` +
+		`[{"uuid":"a","Readings":[[1,1.5]]},{"uuid":"c","Readings":[[5,1]]}]]`
+	ioutil.WriteFile(TEST_VERIFY_FILE, []byte(body), 0644)
+
+	index := newTestSlotIndex()
+	report := &VerifyReport{}
+	err := countFileReadings(TEST_VERIFY_FILE, "", index, report, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.finish(report)
+
+	if report.Slots != 4 || report.Ok != 0 || report.Unmatched != 1 {
+		t.Fatal("unexpected report:", report.Slots, report.Ok, report.Unmatched)
+	}
+	statuses := make(map[int64]string)
+	for _, check := range report.Problems {
+		if check.Uuid == "a" {
+			statuses[check.StartTime] = check.Status
+		}
+	}
+	if statuses[0] != VS_DUPLICATES || statuses[10] != VS_SHORT || statuses[20] != VS_MISSING {
+		t.Fatal("unexpected statuses:", statuses)
+	}
+}
+
+func TestVerifyCountsTruncatedTimes(t *testing.T) {
+	defer os.Remove(TEST_VERIFY_FILE)
+	//source readings at 1.2s and 1.7s of slot [1s, 3s), written in s with equal values
+	body := `[[{"uuid":"a","Readings":[[1,5],[1,5],[2,6]]},{"uuid":"a","Readings":[[3,7]]}]]`
+	ioutil.WriteFile(TEST_VERIFY_FILE, []byte(body), 0644)
+
+	index := newSlotIndex([]*Window{&Window{Uuid: "a", Readings: [][]int64{{1000000000, 3}, {3000000000, 1}}}})
+	report := &VerifyReport{}
+	err := countFileReadings(TEST_VERIFY_FILE, TF_S, index, report, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index.finish(report)
+	if report.Ok != 2 || report.Unmatched != 0 || len(report.Problems) != 0 {
+		t.Fatal("times rounded down to s should be counted in their source slots:", report.Ok, report.Unmatched, report.Problems)
+	}
+}
+
+func TestVerifyRefusesDownsampledOutput(t *testing.T) {
+	config := defaultAdmConfig()
+	config.Downsample.Bucket = "1h"
+	adm := &ADMManager{writeMode: WM_FILE, config: config}
+	_, err := adm.verify(VerifyOptions{requeue: true})
+	if err == nil {
+		t.Fatal("downsampled output should not be verified against source counts")
+	}
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+    "encoding/json"
+    "fmt"
     "time"
 )
 type Window struct {
     Uuid string `json:"uuid"`
-    Readings [][]float64 //API call returns float values. Need to be converted to int64 in TimeSlots.
+    Readings [][]int64 //[start time (ns), count] of each window, parsed exactly
 }
 
 type TimeSlot struct {
@@ -15,22 +17,56 @@ type TimeSlot struct {
     Count int64
 }
 
+/* Parses the readings of a window query, [time, count, ...], keeping the time and
+ * count as exact integers. Decoding them as float64 would round timestamps above 2^53 ns.
+ */
+func (window *Window) UnmarshalJSON(data []byte) error {
+    var raw struct {
+        Uuid string `json:"uuid"`
+        Readings [][]json.Number
+    }
+    err := json.Unmarshal(data, &raw)
+    if err != nil {
+        return err
+    }
+
+    readings := make([][]int64, len(raw.Readings))
+    for i, reading := range raw.Readings {
+        if len(reading) < 2 {
+            return fmt.Errorf("window of uuid %s: reading %v has no count", raw.Uuid, reading)
+        }
+        start, err := parseTimestamp(reading[0].String())
+        if err != nil {
+            return fmt.Errorf("window of uuid %s: %v", raw.Uuid, err)
+        }
+        count, err := parseTimestamp(reading[1].String())
+        if err != nil {
+            return fmt.Errorf("window of uuid %s: bad count %v", raw.Uuid, reading[1])
+        }
+        readings[i] = []int64{start, count}
+    }
+
+    window.Uuid = raw.Uuid
+    window.Readings = readings
+    return nil
+}
+
 func (window *Window) getTimeSlots() []*TimeSlot {
     var slots = make([]*TimeSlot, len(window.Readings))
     length := len(window.Readings)
     for i := 0; i < length; i++ {
         reading := window.Readings[i]
-        startTime := int64(reading[0])
+        startTime := reading[0]
         endTime := int64(-1) //means end time is now
         if i < length - 1 {
-            endTime = int64(window.Readings[i + 1][0])
+            endTime = window.Readings[i + 1][0]
         }
 
         var slot TimeSlot = TimeSlot {
             Uuid: window.Uuid,
             StartTime: startTime,
             EndTime: endTime,
-            Count: int64(reading[1]),
+            Count: reading[1],
         }
         slots[i] = &slot
     }
@@ -48,9 +84,9 @@ func generateDummyWindows(uuids []string, size int64, interval int64) (windows [
 func generateDummyWindow(uuid string, size int64, interval int64) *Window {
     currentTime := time.Now().UnixNano()
     var start int64
-    var readings [][]float64
+    var readings [][]int64
     for start = 0; start < currentTime; start += interval {
-        readings = append(readings, []float64{float64(start), float64(size), 0, 0})
+        readings = append(readings, []int64{start, size})
     } 
 
     return &Window {
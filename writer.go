@@ -8,16 +8,13 @@ Updating logMetadata should be handled by the caller.
 
 package main
 
-type Metadata struct {
-    path       string
-    uuid       string `json:"uuid"`
-    properties interface{}
-    metadata   interface{}
-}
+import (
+    "encoding/json"
+)
 
 type TimeseriesData struct {
-    uuid     string
-    readings interface{} //array of string arrays
+    Uuid     string `json:"uuid"`
+    Readings [][]json.RawMessage `json:"Readings"` //[time, value] pairs kept as raw json to avoid losing precision
 }
 
 type Writer interface { //allows writing to file or to endpoint